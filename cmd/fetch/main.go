@@ -18,10 +18,11 @@ var templateVar string
 var outputPathVar string
 
 func main() {
-	var sourceVar = flag.String("s", "feed.yaml", "path to source yaml")
+	var sourceVar = flag.String("s", "feed.yaml", "path to sources: yaml, json or opml")
 	var trackingPrefixVar = flag.String("p", "", "(Optional) Tracking prefix")
 	var templateVar = flag.String("t", "template.xml", "path to template xml")
 	var outputPathVar = flag.String("o", "output", "output path")
+	var formatVar = flag.String("format", "rss", "output format: rss, atom or json")
 	debugVar := flag.Bool("debug", false, "sets log level to debug")
 
 	flag.Parse()
@@ -44,5 +45,6 @@ func main() {
 		TemplatePath:   *templateVar,
 		OutputPath:     *outputPathVar,
 		TrackingPrefix: *trackingPrefixVar,
+		Format:         *formatVar,
 	})
 }
@@ -0,0 +1,300 @@
+package feed
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dedupWindow is how long repeated requests of an episode from the same
+// client count as a single download, following the IAB podcast measurement
+// guidelines.
+const dedupWindow = 24 * time.Hour
+
+const dayLayout = "2006-01-02"
+
+// DayCount is the number of downloads on a day.
+type DayCount struct {
+	Day       string `json:"day"`
+	Downloads int    `json:"downloads"`
+}
+
+// EpisodeDownloads counts the downloads of an item.
+type EpisodeDownloads struct {
+	ItemID    int64      `json:"itemId"`
+	SourceID  int64      `json:"sourceId"`
+	Title     string     `json:"title"`
+	Downloads int        `json:"downloads"`
+	Days      []DayCount `json:"days"`
+}
+
+// SourceDownloads counts the downloads of the items of a source.
+type SourceDownloads struct {
+	SourceID  int64      `json:"sourceId"`
+	Name      string     `json:"name"`
+	Downloads int        `json:"downloads"`
+	Days      []DayCount `json:"days"`
+}
+
+// ClientDownloads counts the downloads made by a podcast app.
+type ClientDownloads struct {
+	Client    string `json:"client"`
+	Downloads int    `json:"downloads"`
+}
+
+// DownloadReport summarizes the downloads in [From, To).
+type DownloadReport struct {
+	From      time.Time          `json:"from"`
+	To        time.Time          `json:"to"`
+	Requests  int                `json:"requests"`
+	Downloads int                `json:"downloads"`
+	Episodes  []EpisodeDownloads `json:"episodes"`
+	Sources   []SourceDownloads  `json:"sources"`
+	Clients   []ClientDownloads  `json:"clients"`
+}
+
+func (rd *DownloadReport) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// botPattern matches user agents of crawlers, which are not downloads.
+var botPattern = regexp.MustCompile(`(?i)bot\b|crawler|spider|slurp|curl/|wget/|python-requests|go-http-client`)
+
+// clientPatterns map user agents to podcast apps, the first match wins.
+var clientPatterns = []struct {
+	client  string
+	pattern *regexp.Regexp
+}{
+	{"Spotify", regexp.MustCompile(`(?i)spotify`)},
+	{"Overcast", regexp.MustCompile(`(?i)overcast`)},
+	{"Pocket Casts", regexp.MustCompile(`(?i)pocket ?casts`)},
+	{"Castro", regexp.MustCompile(`(?i)castro`)},
+	{"Castbox", regexp.MustCompile(`(?i)castbox`)},
+	{"Podcast Addict", regexp.MustCompile(`(?i)podcastaddict`)},
+	{"Podbean", regexp.MustCompile(`(?i)podbean`)},
+	{"Player FM", regexp.MustCompile(`(?i)player ?fm`)},
+	{"Google Podcasts", regexp.MustCompile(`(?i)googlepodcasts|podcasts\.google`)},
+	{"YouTube Music", regexp.MustCompile(`(?i)youtubemusic|com\.google\.android\.apps\.youtube\.music`)},
+	{"Amazon Music", regexp.MustCompile(`(?i)amazonmusic|alexa`)},
+	{"Apple Podcasts", regexp.MustCompile(`(?i)^podcasts/|applecoremedia|itunes|com\.apple\.podcasts`)},
+	{"Web browser", regexp.MustCompile(`(?i)^mozilla/`)},
+}
+
+// clientName returns the podcast app of a user agent.
+func clientName(userAgent string) string {
+	for _, c := range clientPatterns {
+		if c.pattern.MatchString(userAgent) {
+			return c.client
+		}
+	}
+	return "Other"
+}
+
+// countsAsDownload reports whether a hit may count as a download at all:
+// crawlers and the two byte probes some players send first do not.
+func countsAsDownload(hit Hit) bool {
+	if botPattern.MatchString(hit.UserAgent) {
+		return false
+	}
+	return strings.TrimSpace(hit.Range) != "bytes=0-1"
+}
+
+// dedupHits keeps the hits counted as downloads: the first request of an
+// episode by a client, identified by address and user agent, in every 24
+// hour window. hits must be ordered by time.
+func dedupHits(hits []Hit) []Hit {
+	type clientKey struct {
+		itemID    int64
+		ipHash    string
+		userAgent string
+	}
+	last := make(map[clientKey]time.Time)
+
+	var downloads []Hit
+	for _, hit := range hits {
+		if !countsAsDownload(hit) {
+			continue
+		}
+		key := clientKey{hit.ItemID, hit.IPHash, hit.UserAgent}
+		if t, ok := last[key]; ok && hit.CreatedAt.Sub(t) < dedupWindow {
+			continue
+		}
+		last[key] = hit.CreatedAt
+		downloads = append(downloads, hit)
+	}
+	return downloads
+}
+
+// buildDownloadReport reports the downloads in [from, to), of a single
+// source when sourceID is not zero.
+func buildDownloadReport(from time.Time, to time.Time, sourceID int64) (*DownloadReport, error) {
+	// hits just before the range may make later ones duplicates
+	hits, err := DbListHits(from.Add(-dedupWindow), to, sourceID)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &DownloadReport{
+		From:     from,
+		To:       to,
+		Episodes: []EpisodeDownloads{},
+		Sources:  []SourceDownloads{},
+		Clients:  []ClientDownloads{},
+	}
+	episodes := make(map[int64]*EpisodeDownloads)
+	sources := make(map[int64]*SourceDownloads)
+	episodeDays := make(map[int64]map[string]int)
+	sourceDays := make(map[int64]map[string]int)
+	clients := make(map[string]int)
+
+	for _, hit := range hits {
+		if !hit.CreatedAt.Before(from) {
+			report.Requests++
+		}
+	}
+	for _, hit := range dedupHits(hits) {
+		if hit.CreatedAt.Before(from) {
+			continue
+		}
+		report.Downloads++
+		day := hit.CreatedAt.In(time.Local).Format(dayLayout)
+
+		episode, ok := episodes[hit.ItemID]
+		if !ok {
+			episode = &EpisodeDownloads{ItemID: hit.ItemID, SourceID: hit.SourceID}
+			episodes[hit.ItemID] = episode
+			episodeDays[hit.ItemID] = make(map[string]int)
+		}
+		episode.Downloads++
+		episodeDays[hit.ItemID][day]++
+
+		source, ok := sources[hit.SourceID]
+		if !ok {
+			source = &SourceDownloads{SourceID: hit.SourceID}
+			sources[hit.SourceID] = source
+			sourceDays[hit.SourceID] = make(map[string]int)
+		}
+		source.Downloads++
+		sourceDays[hit.SourceID][day]++
+
+		clients[clientName(hit.UserAgent)]++
+	}
+
+	itemIDs := make([]int64, 0, len(episodes))
+	for id := range episodes {
+		itemIDs = append(itemIDs, id)
+	}
+	items, err := DbGetItems(itemIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		episodes[item.ID].Title = item.Title
+	}
+	for _, s := range DbListSource() {
+		if source, ok := sources[s.ID]; ok {
+			source.Name = s.Name
+		}
+	}
+
+	for id, episode := range episodes {
+		episode.Days = dayCounts(episodeDays[id])
+		report.Episodes = append(report.Episodes, *episode)
+	}
+	sort.Slice(report.Episodes, func(i, j int) bool {
+		return report.Episodes[i].Downloads > report.Episodes[j].Downloads
+	})
+	for id, source := range sources {
+		source.Days = dayCounts(sourceDays[id])
+		report.Sources = append(report.Sources, *source)
+	}
+	sort.Slice(report.Sources, func(i, j int) bool {
+		return report.Sources[i].Downloads > report.Sources[j].Downloads
+	})
+	for client, downloads := range clients {
+		report.Clients = append(report.Clients, ClientDownloads{Client: client, Downloads: downloads})
+	}
+	sort.Slice(report.Clients, func(i, j int) bool {
+		if report.Clients[i].Downloads == report.Clients[j].Downloads {
+			return report.Clients[i].Client < report.Clients[j].Client
+		}
+		return report.Clients[i].Downloads > report.Clients[j].Downloads
+	})
+	return report, nil
+}
+
+func dayCounts(days map[string]int) []DayCount {
+	counts := make([]DayCount, 0, len(days))
+	for day, downloads := range days {
+		counts = append(counts, DayCount{Day: day, Downloads: downloads})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		return counts[i].Day < counts[j].Day
+	})
+	return counts
+}
+
+// reportParams reads the report range and source from the query string.
+// from and to are days, to is included, the default is the last 30 days.
+func reportParams(r *http.Request) (time.Time, time.Time, int64, error) {
+	query := r.URL.Query()
+	now := time.Now().In(time.Local)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+
+	to := today.AddDate(0, 0, 1)
+	if v := query.Get("to"); v != "" {
+		t, err := time.ParseInLocation(dayLayout, v, time.Local)
+		if err != nil {
+			return time.Time{}, time.Time{}, 0, err
+		}
+		to = t.AddDate(0, 0, 1)
+	}
+	from := to.AddDate(0, 0, -30)
+	if v := query.Get("from"); v != "" {
+		t, err := time.ParseInLocation(dayLayout, v, time.Local)
+		if err != nil {
+			return time.Time{}, time.Time{}, 0, err
+		}
+		from = t
+	}
+
+	var sourceID int64
+	if v := query.Get("source"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return time.Time{}, time.Time{}, 0, err
+		}
+		sourceID = id
+	}
+	return from, to, sourceID, nil
+}
+
+func analyticsHandler(w http.ResponseWriter, r *http.Request) {
+	from, to, sourceID, err := reportParams(r)
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	report, err := buildDownloadReport(from, to, sourceID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = renderTemplate(w, r, "analytics.html", map[string]interface{}{
+		"report":   report,
+		"from":     from.Format(dayLayout),
+		"to":       to.AddDate(0, 0, -1).Format(dayLayout),
+		"sourceID": sourceID,
+		"sources":  DbListSource(),
+	})
+	if err != nil {
+		fmt.Printf("\nRender Error: %v\n", err)
+		return
+	}
+}
@@ -1,22 +1,57 @@
 package feed
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
+
+	"github.com/wiennat/rjio/pkg/feedfmt"
+)
+
+const (
+	defaultItemLimit = 50
+	maxItemLimit     = 500
 )
 
 func ApiRouter() http.Handler {
 	r := chi.NewRouter()
-	r.Route("/feeds", func(r chi.Router) {
-		r.Get("/", getFeedSourceListHandler)
+	r.Get("/openapi.json", getOpenAPIHandler)
+
+	r.Group(func(r chi.Router) {
+		r.Use(ApiAuthMiddleware)
+		r.Use(ValidateRequestMiddleware)
+
+		r.Route("/feeds", func(r chi.Router) {
+			r.With(RequireScope(scopeRead)).Get("/", getFeedSourceListHandler)
+			r.With(RequireScope(scopeManageSources)).Post("/", createFeedSourceHandler)
+			r.With(RequireScope(scopeManageSources)).Post("/import", importFeedSourcesHandler)
 
-		r.Route("/{sourceID}", func(r chi.Router) {
-			r.Use(FeedSourceCtx)
-			r.Get("/", getFeedSourceHandler)
-			r.Get("/items", getFeedItemsHandler)
+			r.Route("/{sourceID}", func(r chi.Router) {
+				r.Use(ApiFeedSourceCtx)
+				r.With(RequireScope(scopeRead)).Get("/", getFeedSourceHandler)
+				r.With(RequireScope(scopeManageSources)).Put("/", replaceFeedSourceHandler)
+				r.With(RequireScope(scopeManageSources)).Patch("/", patchFeedSourceHandler)
+				r.With(RequireScope(scopeManageSources)).Delete("/", deleteFeedSourceHandler)
+				r.With(RequireScope(scopeRead)).Get("/items", listFeedItemsHandler)
+				r.With(RequireScope(scopeRefresh)).Post("/refresh", refreshFeedSourceHandler)
+
+				r.Route("/items/{itemID}/override", func(r chi.Router) {
+					r.Use(ApiItemCtx)
+					r.With(RequireScope(scopeRead)).Get("/", getItemOverrideHandler)
+					r.With(RequireScope(scopeManageSources)).Put("/", putItemOverrideHandler)
+					r.With(RequireScope(scopeManageSources)).Delete("/", deleteItemOverrideHandler)
+				})
+			})
 		})
+		r.With(RequireScope(scopeRead)).Get("/analytics", getAnalyticsHandler)
 	})
 	return r
 }
@@ -45,6 +80,286 @@ func getFeedSourceHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// ApiFeedSourceCtx loads the source of the request like FeedSourceCtx,
+// answering with JSON errors.
+func ApiFeedSourceCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sid, err := strconv.ParseInt(chi.URLParam(r, "sourceID"), 10, 64)
+		if err != nil {
+			render.Render(w, r, ErrInvalidRequest(fmt.Errorf("invalid source id")))
+			return
+		}
+		source, err := DbGetSource(sid)
+		if err == ErrNotFound {
+			render.Render(w, r, ErrResourceNotFound)
+			return
+		}
+		if err != nil {
+			render.Render(w, r, ErrInternal(err))
+			return
+		}
+		ctx := context.WithValue(r.Context(), "source", source)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// SourceRequest is the body of source requests. Fields left out keep their
+// value on PATCH, on POST and PUT slug, name and url are required and the
+// other fields take their default.
+type SourceRequest struct {
+	Slug     *string `json:"slug"`
+	Name     *string `json:"name"`
+	URL      *string `json:"url"`
+	Interval *string `json:"interval"`
+	// Enabled defaults to true and HideItems to false, an empty PausedUntil
+	// resumes the source
+	Enabled     *bool   `json:"enabled"`
+	PausedUntil *string `json:"pausedUntil"`
+	HideItems   *bool   `json:"hideItems"`
+}
+
+func (req *SourceRequest) Bind(r *http.Request) error {
+	return nil
+}
+
+// apply sets the fields of the request on source, checking every field when
+// partial is false.
+func (req *SourceRequest) apply(source *Source, partial bool) error {
+	if !partial && (req.Slug == nil || req.Name == nil || req.URL == nil) {
+		return errors.New("slug, name and url are required")
+	}
+	if req.Slug != nil {
+		if *req.Slug == "" {
+			return errors.New("slug is required")
+		}
+		source.Slug = *req.Slug
+	}
+	if req.Name != nil {
+		if *req.Name == "" {
+			return errors.New("name is required")
+		}
+		source.Name = *req.Name
+	}
+	if req.URL != nil {
+		u, err := url.Parse(*req.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("url must be an http or https URL")
+		}
+		source.URL = *req.URL
+	}
+	if req.Interval != nil || !partial {
+		var value string
+		if req.Interval != nil {
+			value = *req.Interval
+		}
+		interval, err := parseInterval(value)
+		if err != nil {
+			return fmt.Errorf("invalid interval, %v", err)
+		}
+		source.FetchInterval = interval
+	}
+	if req.Enabled != nil {
+		source.Enabled = *req.Enabled
+	} else if !partial {
+		source.Enabled = true
+	}
+	if req.HideItems != nil {
+		source.HideItems = *req.HideItems
+	} else if !partial {
+		source.HideItems = false
+	}
+	if req.PausedUntil != nil || !partial {
+		source.PausedUntil = time.Time{}
+		if req.PausedUntil != nil && *req.PausedUntil != "" {
+			t, err := time.Parse(time.RFC3339, *req.PausedUntil)
+			if err != nil {
+				return fmt.Errorf("invalid pausedUntil, %v", err)
+			}
+			source.PausedUntil = t
+		}
+	}
+	return nil
+}
+
+func createFeedSourceHandler(w http.ResponseWriter, r *http.Request) {
+	var req SourceRequest
+	if err := render.Bind(r, &req); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	var source Source
+	if err := req.apply(&source, false); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if sourceSlugTaken(source.Slug, 0) {
+		render.Render(w, r, ErrConflict(fmt.Errorf("slug %s is already used", source.Slug)))
+		return
+	}
+
+	if err := DbCreateSource(&source); err != nil {
+		render.Render(w, r, ErrInternal(err))
+		return
+	}
+
+	go func(source Source) {
+		log.Printf("updating feed items. source=%d, slug=%s", source.ID, source.Slug)
+		fetcher.UpdateFeed(&source)
+	}(source)
+
+	render.Status(r, http.StatusCreated)
+	if err := render.Render(w, r, NewFeedSourceResponse(&source)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+func replaceFeedSourceHandler(w http.ResponseWriter, r *http.Request) {
+	updateFeedSource(w, r, false)
+}
+
+func patchFeedSourceHandler(w http.ResponseWriter, r *http.Request) {
+	updateFeedSource(w, r, true)
+}
+
+func updateFeedSource(w http.ResponseWriter, r *http.Request, partial bool) {
+	source := r.Context().Value("source").(Source)
+
+	var req SourceRequest
+	if err := render.Bind(r, &req); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	updated := source
+	if err := req.apply(&updated, partial); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+	if sourceSlugTaken(updated.Slug, source.ID) {
+		render.Render(w, r, ErrConflict(fmt.Errorf("slug %s is already used", updated.Slug)))
+		return
+	}
+
+	if err := saveSource(&updated, source.URL); err != nil {
+		render.Render(w, r, ErrInternal(err))
+		return
+	}
+	if err := DbUpdateSourceState(&updated); err != nil {
+		render.Render(w, r, ErrInternal(err))
+		return
+	}
+	if updated.URL != source.URL {
+		go func(source Source) {
+			log.Printf("updating feed items. source=%d, slug=%s", source.ID, source.Slug)
+			fetcher.UpdateFeed(&source)
+		}(updated)
+	}
+
+	if err := render.Render(w, r, NewFeedSourceResponse(&updated)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+func deleteFeedSourceHandler(w http.ResponseWriter, r *http.Request) {
+	source := r.Context().Value("source").(Source)
+
+	if err := deleteSource(source.ID); err != nil {
+		render.Render(w, r, ErrInternal(err))
+		return
+	}
+	render.NoContent(w, r)
+}
+
+// listFeedItemsHandler lists the items of a source, the newest first. The
+// offset, limit and since (an RFC 3339 time or a date) query parameters page
+// through them.
+func listFeedItemsHandler(w http.ResponseWriter, r *http.Request) {
+	source := r.Context().Value("source").(Source)
+	query := r.URL.Query()
+
+	offset, err := queryInt(query.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		render.Render(w, r, ErrInvalidRequest(fmt.Errorf("invalid offset")))
+		return
+	}
+	limit, err := queryInt(query.Get("limit"), defaultItemLimit)
+	if err != nil || limit <= 0 || limit > maxItemLimit {
+		render.Render(w, r, ErrInvalidRequest(fmt.Errorf("limit must be between 1 and %d", maxItemLimit)))
+		return
+	}
+	var since time.Time
+	if v := query.Get("since"); v != "" {
+		since, err = feedfmt.ParseDate(v)
+		if err != nil {
+			render.Render(w, r, ErrInvalidRequest(fmt.Errorf("invalid since, %v", err)))
+			return
+		}
+	}
+
+	items, err := DbListSourceItems(source.ID, since, offset, limit)
+	if err != nil {
+		render.Render(w, r, ErrInternal(err))
+		return
+	}
+
+	list := []render.Renderer{}
+	for i := range items {
+		list = append(list, &ItemResponse{Item: &items[i]})
+	}
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+func queryInt(value string, fallback int) (int, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// refreshFeedSourceHandler fetches a source right away and returns it with
+// its new fetch state, or a 502 when the fetch failed.
+func refreshFeedSourceHandler(w http.ResponseWriter, r *http.Request) {
+	source := r.Context().Value("source").(Source)
+
+	// a manual refresh always downloads and parses the feed again
+	source.ETag, source.LastModified, source.ContentHash = "", "", ""
+
+	log.Printf("updating feed items. source=%d, slug=%s", source.ID, source.Slug)
+	if err := fetcher.UpdateFeed(&source); err != nil {
+		render.Render(w, r, ErrFetch(err))
+		return
+	}
+
+	if err := render.Render(w, r, NewFeedSourceResponse(&source)); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+func getAnalyticsHandler(w http.ResponseWriter, r *http.Request) {
+	from, to, sourceID, err := reportParams(r)
+	if err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	report, err := buildDownloadReport(from, to, sourceID)
+	if err != nil {
+		render.Render(w, r, ErrInternal(err))
+		return
+	}
+	if err := render.Render(w, r, report); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
 // ErrResponse renderer type for handling all sorts of errors.
 //
 // In the best case scenario, the excellent github.com/pkg/errors package
@@ -73,6 +388,49 @@ func ErrInvalidRequest(err error) render.Renderer {
 	}
 }
 
+// ErrUnauthorized is returned to API clients without a session or a valid
+// token.
+var ErrUnauthorized = &ErrResponse{HTTPStatusCode: 401, StatusText: "Unauthorized."}
+
+func ErrForbidden(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 403,
+		StatusText:     "Forbidden.",
+		ErrorText:      err.Error(),
+	}
+}
+
+// ErrResourceNotFound is returned for requests of records that do not exist.
+var ErrResourceNotFound = &ErrResponse{HTTPStatusCode: 404, StatusText: "Resource not found."}
+
+func ErrConflict(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 409,
+		StatusText:     "Conflict.",
+		ErrorText:      err.Error(),
+	}
+}
+
+func ErrInternal(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 500,
+		StatusText:     "Internal server error.",
+		ErrorText:      err.Error(),
+	}
+}
+
+func ErrFetch(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 502,
+		StatusText:     "Fetching the source failed.",
+		ErrorText:      err.Error(),
+	}
+}
+
 func ErrRender(err error) render.Renderer {
 	return &ErrResponse{
 		Err:            err,
@@ -82,9 +440,12 @@ func ErrRender(err error) render.Renderer {
 	}
 }
 
-//
+// FeedSourceResponse is a source as the API writes it.
 type FeedSourceResponse struct {
 	*Source
+	// intervals are written as the duration strings requests take
+	FetchInterval    string `json:"fetchInterval"`
+	UpstreamInterval string `json:"upstreamInterval"`
 }
 
 func NewFeedSourceListResponse(sources []*Source) []render.Renderer {
@@ -97,10 +458,22 @@ func NewFeedSourceListResponse(sources []*Source) []render.Renderer {
 }
 
 func NewFeedSourceResponse(source *Source) *FeedSourceResponse {
-	resp := FeedSourceResponse{Source: source}
+	resp := FeedSourceResponse{
+		Source:           source,
+		FetchInterval:    formatInterval(source.FetchInterval),
+		UpstreamInterval: formatInterval(source.UpstreamInterval),
+	}
 	return &resp
 }
 
 func (rd *FeedSourceResponse) Render(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
+
+type ItemResponse struct {
+	*Item
+}
+
+func (rd *ItemResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
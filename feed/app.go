@@ -6,10 +6,12 @@ import (
 	"fmt"
 	"log"
 
+	"html/template"
 	"net/http"
 	"net/http/pprof"
+	"path"
 	"strconv"
-	"text/template"
+	"strings"
 	text "text/template"
 	"time"
 
@@ -17,6 +19,7 @@ import (
 	"github.com/go-chi/chi/middleware"
 	"github.com/gorilla/sessions"
 
+	"github.com/wiennat/rjio/pkg/feedfmt"
 	"github.com/wiennat/rjio/templates"
 )
 
@@ -26,16 +29,23 @@ const (
 
 // Config stores all configuration
 type Config struct {
-	Channel  ChannelConfig  `yaml:"channel"`
-	Database DatabaseConfig `yaml:"database"`
-	Server   ServerConfig   `yaml:"server"`
-	Fetcher  FetcherConfig  `yaml:"fetcher"`
+	Channel   ChannelConfig             `yaml:"channel"`
+	Channels  map[string]ChannelOptions `yaml:"channels"`
+	Sources   map[string]SourceConfig   `yaml:"sources"`
+	Database  DatabaseConfig            `yaml:"database"`
+	Server    ServerConfig              `yaml:"server"`
+	Fetcher   FetcherConfig             `yaml:"fetcher"`
+	Retention RetentionConfig           `yaml:"retention"`
+	Dedup     DedupConfig               `yaml:"dedup"`
 }
 
 type ServerConfig struct {
 	SessionKey string `yaml:"session-key"`
 	Username   string `yaml:"username"`
 	Password   string `yaml:"password"`
+	// BaseURL is the public URL of rjio, used for download links. The host of
+	// the feed request is used when empty.
+	BaseURL string `yaml:"base-url"`
 }
 
 // ChannelConfig represents program configuration
@@ -53,6 +63,51 @@ type ChannelConfig struct {
 	Explicit       string `yaml:"explicit"`
 	CoverURL       string `yaml:"cover-url"`
 	TrackingPrefix string `yaml:"tracking-prefix"`
+	// TrackDownloads points enclosures to rjio, which records the download
+	// and redirects to the original URL, the prefix and trackers are not
+	// used then
+	TrackDownloads bool `yaml:"track-downloads"`
+
+	// Rules rewrite the items of the channel when it is served, after the
+	// rules of their source, itunes:season is removed when no rules are set
+	Rules []feedfmt.Rule `yaml:"rules" xorm:"-"`
+	// Filters select the items of the channel when it is served, they are
+	// stored with channels created in the admin pages
+	Filters []FilterRule `yaml:"filters" xorm:" text null"`
+	// Trackers rewrite enclosure URLs after the tracking prefix
+	Trackers []feedfmt.Tracker `yaml:"trackers" xorm:"-"`
+	// Publish limits the items of each source published over time
+	Publish PublishConfig `yaml:"publish" xorm:"-"`
+}
+
+func (c ChannelConfig) enclosureRewriter() (feedfmt.EnclosureRewriter, error) {
+	return feedfmt.NewEnclosureRewriter(c.TrackingPrefix, c.Trackers)
+}
+
+// ChannelOptions holds settings of a channel managed in the admin pages,
+// keyed by its slug
+type ChannelOptions struct {
+	Rules    []feedfmt.Rule    `yaml:"rules"`
+	Filters  []FilterRule      `yaml:"filters"`
+	Trackers []feedfmt.Tracker `yaml:"trackers"`
+	Publish  PublishConfig     `yaml:"publish"`
+}
+
+// SourceConfig holds settings of a single source, keyed by its slug
+type SourceConfig struct {
+	// Rules rewrite the items of the source when they are fetched, before
+	// the channel rules
+	Rules []feedfmt.Rule `yaml:"rules"`
+	// Filters select the items of the source in every channel
+	Filters []FilterRule `yaml:"filters"`
+	// Retention overrides the global retention of items
+	Retention RetentionConfig `yaml:"retention"`
+	// Priority decides which copy of an item published by several sources
+	// is served, the highest wins
+	Priority int `yaml:"priority"`
+	// PublishDelay holds items back from the feeds for this long after they
+	// are first seen
+	PublishDelay time.Duration `yaml:"publish-delay"`
 }
 
 type DatabaseConfig struct {
@@ -73,6 +128,41 @@ func SetupFetcher(c *Config) *Fetcher {
 func SetupHandler(c *Config) *chi.Mux {
 	cfg = c
 	store = sessions.NewCookieStore([]byte(cfg.Server.SessionKey))
+	store.Options = &sessions.Options{
+		Path:     "/",
+		MaxAge:   sessionMaxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if err := validateCredentials(cfg.Server); err != nil {
+		log.Fatalf("invalid server config: %v", err)
+	}
+	if err := loadFilters(cfg); err != nil {
+		log.Fatalf("invalid filters: %v", err)
+	}
+	if err := validateDedup(cfg.Dedup); err != nil {
+		log.Fatalf("invalid dedup config: %v", err)
+	}
+	if err := validatePublishing(cfg); err != nil {
+		log.Fatalf("invalid publish config: %v", err)
+	}
+	if err := loadPublishSettings(cfg); err != nil {
+		log.Fatalf("cannot load publish settings: %v", err)
+	}
+	if _, err := cfg.Channel.enclosureRewriter(); err != nil {
+		log.Fatalf("invalid channel trackers: %v", err)
+	}
+	if _, err := feedfmt.NewRewriter(cfg.Channel.Rules); err != nil {
+		log.Fatalf("invalid channel rules: %v", err)
+	}
+	for slug, channel := range cfg.Channels {
+		if _, err := feedfmt.NewRewriter(channel.Rules); err != nil {
+			log.Fatalf("invalid rules for channel %s: %v", slug, err)
+		}
+		if _, err := feedfmt.NewEnclosureRewriter("", channel.Trackers); err != nil {
+			log.Fatalf("invalid trackers for channel %s: %v", slug, err)
+		}
+	}
 
 	r := chi.NewRouter()
 
@@ -85,34 +175,84 @@ func SetupHandler(c *Config) *chi.Mux {
 
 	r.Get("/", indexHandler)
 	r.Get("/rss", customFeedHandler)
-	r.Route("/feeds", func(r chi.Router) {
-		r.Use(FlashMiddleware)
-		r.Get("/", listSourcesHandler)
-		r.Post("/", createSourceHandler)
-
-		r.Route("/{sourceID}", func(r chi.Router) {
-			r.Use(FeedSourceCtx)
-			r.Get("/items", getFeedItemsHandler)
-			r.Get("/edit", updateSourceFormHandler)
-			r.Post("/edit", updateSourceHandler)
-			r.Delete("/", deleteSourceHandler)
-			r.Get("/delete", confirmDeleteSourceHandler)
-			r.Post("/delete", deleteSourceHandler)
-			r.Post("/refresh", refreshFeedItemsHandler)
-		})
-	})
-
+	r.Get("/atom", customFeedHandler)
+	r.Get("/feed.json", customFeedHandler)
+	r.Get("/channels/{channelSlug}/rss", channelFeedHandler)
+	r.Get("/channels/{channelSlug}/atom", channelFeedHandler)
+	r.Get("/channels/{channelSlug}/feed.json", channelFeedHandler)
+	r.Get("/e/{itemID}/{filename}", downloadHandler)
+	r.Head("/e/{itemID}/{filename}", downloadHandler)
+	r.Get("/login", loginFormHandler)
+	r.Post("/login", loginHandler)
+	r.With(CSRFMiddleware).Post("/logout", logoutHandler)
+
+	// the api also takes tokens, see ApiAuthMiddleware
 	r.Mount("/api/", ApiRouter())
 
-	r.Get("/debug/pprof/", pprof.Index)
-	r.Get("/debug/pprof/cmdline", pprof.Cmdline)
-	r.Get("/debug/pprof/profile", pprof.Profile)
-	r.Get("/debug/pprof/symbol", pprof.Symbol)
+	// everything else is for the admin only
+	r.Group(func(r chi.Router) {
+		r.Use(AuthMiddleware)
+
+		r.Route("/feeds", func(r chi.Router) {
+			r.Use(FlashMiddleware)
+			r.Use(CSRFMiddleware)
+			r.Get("/", listSourcesHandler)
+			r.Post("/", createSourceHandler)
+			r.Get("/preview", previewFeedHandler)
+			r.Get("/analytics", analyticsHandler)
+			r.Get("/duplicates", duplicatesHandler)
+			r.Get("/export.opml", exportOPMLHandler)
+			r.Post("/import", importOPMLHandler)
+
+			r.Route("/channels", func(r chi.Router) {
+				r.Get("/", listChannelsHandler)
+				r.Post("/", createChannelHandler)
+
+				r.Route("/{channelID}", func(r chi.Router) {
+					r.Use(ChannelCtx)
+					r.Get("/edit", updateChannelFormHandler)
+					r.Post("/edit", updateChannelHandler)
+					r.Get("/preview", previewChannelHandler)
+					r.Get("/delete", confirmDeleteChannelHandler)
+					r.Post("/delete", deleteChannelHandler)
+				})
+			})
+
+			r.Route("/tokens", func(r chi.Router) {
+				r.Get("/", listTokensHandler)
+				r.Post("/", createTokenHandler)
+				r.With(ApiTokenCtx).Post("/{tokenID}/delete", deleteTokenHandler)
+			})
+
+			r.Route("/{sourceID}", func(r chi.Router) {
+				r.Use(FeedSourceCtx)
+				r.Get("/items", getFeedItemsHandler)
+				r.Route("/items/{itemID}", func(r chi.Router) {
+					r.Use(ItemCtx)
+					r.Post("/restore", restoreItemHandler)
+					r.Get("/edit", updateItemFormHandler)
+					r.Post("/edit", updateItemHandler)
+				})
+				r.Get("/edit", updateSourceFormHandler)
+				r.Post("/edit", updateSourceHandler)
+				r.Delete("/", deleteSourceHandler)
+				r.Get("/delete", confirmDeleteSourceHandler)
+				r.Post("/delete", deleteSourceHandler)
+				r.Post("/refresh", refreshFeedItemsHandler)
+				r.Post("/state", sourceStateHandler)
+			})
+		})
 
-	r.Handle("/debug/pprof/goroutine", pprof.Handler("goroutine"))
-	r.Handle("/debug/pprof/heap", pprof.Handler("heap"))
-	r.Handle("/debug/pprof/threadcreate", pprof.Handler("threadcreate"))
-	r.Handle("/debug/pprof/block", pprof.Handler("block"))
+		r.Get("/debug/pprof/", pprof.Index)
+		r.Get("/debug/pprof/cmdline", pprof.Cmdline)
+		r.Get("/debug/pprof/profile", pprof.Profile)
+		r.Get("/debug/pprof/symbol", pprof.Symbol)
+
+		r.Handle("/debug/pprof/goroutine", pprof.Handler("goroutine"))
+		r.Handle("/debug/pprof/heap", pprof.Handler("heap"))
+		r.Handle("/debug/pprof/threadcreate", pprof.Handler("threadcreate"))
+		r.Handle("/debug/pprof/block", pprof.Handler("block"))
+	})
 	return r
 }
 
@@ -150,18 +290,79 @@ func customFeedHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	d, _, err = selectChannelItems(defaultChannel(), d, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderFeed(w, r, cfg.Channel, capFeedItems(d))
+}
+
+// previewFeedHandler lists the items of the default channel along with those
+// left out by filters.
+func previewFeedHandler(w http.ResponseWriter, r *http.Request) {
+	d, err := DbGetItemsForCustomFeed(0, 9999)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderPreview(w, r, defaultChannel(), d)
+}
 
-	// add prefix enclosure
-	d, err = ApplyEnclosurePrefix(d, cfg.Channel.TrackingPrefix)
+// renderPreview renders the filter preview of a channel.
+func renderPreview(w http.ResponseWriter, r *http.Request, channel Channel, d []Item) {
+	kept, dropped, err := selectChannelItems(channel, d, false)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	err = renderText(w, "rss_raw.xml", map[string]interface{}{
-		"Entries": d,
-		"Config":  cfg.Channel,
+	err = renderTemplate(w, r, "preview_channel.html", map[string]interface{}{
+		"title":    channel.Title,
+		"items":    kept,
+		"filtered": dropped,
 	})
+	if err != nil {
+		fmt.Printf("\nRender Error: %v\n", err)
+		return
+	}
+}
+
+// renderFeed writes items as the feed of a channel, in the format asked for
+// by the last segment of the request path: atom, feed.json or RSS otherwise.
+func renderFeed(w http.ResponseWriter, r *http.Request, channel ChannelConfig, d []Item) {
+	d, err := applyChannelRules(d, channel.Rules)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if channel.TrackDownloads {
+		d = applyDownloadTracking(d, baseURL(r))
+	} else {
+		var rewriter feedfmt.EnclosureRewriter
+		rewriter, err = channel.enclosureRewriter()
+		if err == nil {
+			d = ApplyEnclosureRewriter(d, rewriter)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch path.Base(r.URL.Path) {
+	case "atom":
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		err = feedfmt.WriteAtom(w, channel.feedInfo(requestURL(r)), feedEntries(d))
+	case "feed.json":
+		w.Header().Set("Content-Type", feedfmt.JSONFeedMediaType+"; charset=utf-8")
+		err = feedfmt.WriteJSONFeed(w, channel.feedInfo(requestURL(r)), feedEntries(d))
+	default:
+		err = renderText(w, "rss_raw.xml", map[string]interface{}{
+			"Entries": d,
+			"Config":  channel,
+		})
+	}
 
 	if err != nil {
 		fmt.Printf("\nRender Error: %v\n", err)
@@ -169,14 +370,94 @@ func customFeedHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// applyChannelRules rewrites the items of a channel with its rules, the
+// default rules when none are set. Items that cannot be rewritten are logged
+// and served as stored.
+func applyChannelRules(items []Item, rules []feedfmt.Rule) ([]Item, error) {
+	if rules == nil {
+		rules = feedfmt.DefaultRules
+	}
+	rewriter, err := feedfmt.NewRewriter(rules)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return items, nil
+	}
+
+	// rule values may refer to the source of the item
+	sources := make(map[int64]Source)
+	for _, source := range DbListSource() {
+		sources[source.ID] = source
+	}
+	for i := range items {
+		node, err := feedfmt.ParseItem(items[i].Entry)
+		if err == nil {
+			err = rewriter.Apply(node, sources[items[i].FeedID])
+		}
+		if err != nil {
+			log.Printf("Serving item %d without channel rules, err=%v", items[i].ID, err)
+			continue
+		}
+		items[i].Entry = feedfmt.OutputXML(node)
+		items[i].SetEntryFields(feedfmt.ReadItem(node))
+	}
+	return items, nil
+}
+
+// feedInfo describes the channel for the Atom and JSON feeds served from
+// feedLink.
+func (c ChannelConfig) feedInfo(feedLink string) feedfmt.FeedInfo {
+	return feedfmt.FeedInfo{
+		Title:       c.Title,
+		Description: c.Description,
+		Link:        c.PermaLink,
+		FeedLink:    feedLink,
+		Author:      c.Author,
+		Email:       c.Email,
+		Language:    c.Language,
+		CoverURL:    c.CoverURL,
+	}
+}
+
+func feedEntries(d []Item) []feedfmt.Entry {
+	entries := make([]feedfmt.Entry, 0, len(d))
+	for _, item := range d {
+		entries = append(entries, item.FeedEntry())
+	}
+	return entries
+}
+
+// requestURL rebuilds the absolute URL of a request, honouring the scheme
+// set by a reverse proxy.
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host + r.URL.Path
+}
+
+// baseURL returns the public URL of rjio without a trailing slash.
+func baseURL(r *http.Request) string {
+	if cfg.Server.BaseURL != "" {
+		return strings.TrimSuffix(cfg.Server.BaseURL, "/")
+	}
+	return strings.TrimSuffix(requestURL(r), r.URL.Path)
+}
+
 func listSourcesHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	flash := ctx.Value("flash")
 
 	sources := DbListSource()
-	err := renderTemplate(w, "list.html", map[string]interface{}{
+	err := renderTemplate(w, r, "list.html", map[string]interface{}{
 		"sources": sources,
 		"message": flash,
+		"now":     time.Now(),
 	})
 
 	if err != nil {
@@ -203,12 +484,6 @@ func FeedSourceCtx(next http.Handler) http.Handler {
 	})
 }
 
-type SourceRequest struct {
-	Slug string
-	Name string
-	URL  string
-}
-
 func createSourceHandler(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	slug := r.Form.Get("slug")
@@ -216,6 +491,10 @@ func createSourceHandler(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(fmt.Sprintf("slug is required")))
 		return
 	}
+	if sourceSlugTaken(slug, 0) {
+		w.Write([]byte(fmt.Sprintf("slug %s is already used", slug)))
+		return
+	}
 
 	name := r.Form.Get("name")
 	if name == "" {
@@ -228,13 +507,21 @@ func createSourceHandler(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(fmt.Sprintf("url is required")))
 		return
 	}
+
+	interval, err := parseInterval(r.Form.Get("interval"))
+	if err != nil {
+		w.Write([]byte(fmt.Sprintf("invalid interval, %v", err)))
+		return
+	}
 	source := Source{
-		Slug: slug,
-		Name: name,
-		URL:  url,
+		Slug:          slug,
+		Name:          name,
+		URL:           url,
+		FetchInterval: interval,
+		Enabled:       true,
 	}
 	DbCreateSource(&source)
-	err := saveFlash(w, r, fmt.Sprintf("new feed source added, id=%s", source.ID))
+	err = saveFlash(w, r, fmt.Sprintf("new feed source added, id=%d", source.ID))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -257,7 +544,7 @@ func updateSourceFormHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := renderTemplate(w, "edit_source.html", map[string]interface{}{
+	err := renderTemplate(w, r, "edit_source.html", map[string]interface{}{
 		"source": source,
 	})
 
@@ -282,6 +569,10 @@ func updateSourceHandler(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(fmt.Sprintf("slug is required")))
 		return
 	}
+	if sourceSlugTaken(slug, source.ID) {
+		w.Write([]byte(fmt.Sprintf("slug %s is already used", slug)))
+		return
+	}
 
 	name := r.Form.Get("name")
 	if name == "" {
@@ -295,14 +586,21 @@ func updateSourceHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	interval, err := parseInterval(r.Form.Get("interval"))
+	if err != nil {
+		w.Write([]byte(fmt.Sprintf("invalid interval, %v", err)))
+		return
+	}
+
 	newSource := Source{
-		ID:   source.ID,
-		Slug: slug,
-		Name: name,
-		URL:  url,
+		ID:            source.ID,
+		Slug:          slug,
+		Name:          name,
+		URL:           url,
+		FetchInterval: interval,
 	}
 
-	err := DbUpdateSource(&newSource)
+	err = saveSource(&newSource, source.URL)
 	if err != nil {
 		log.Printf("cannot update source, err=%s", err)
 		http.Error(w, http.StatusText(500), 500)
@@ -322,13 +620,83 @@ func updateSourceHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		err := fetcher.UpdateFeed(&source)
 		if err != nil {
-			log.Printf("Cannot update items, err=%v", source.ID, err)
+			log.Printf("Cannot update items, ID=%d, err=%v", source.ID, err)
 			return
 		}
 	}()
 	http.Redirect(w, r, "/feeds", http.StatusSeeOther)
 }
 
+// parseInterval reads an optional fetch interval, an empty value means the
+// fetcher default.
+func parseInterval(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if interval < 0 {
+		return 0, fmt.Errorf("interval must be positive")
+	}
+	return interval, nil
+}
+
+// formatInterval writes interval the way parseInterval reads it, dropping
+// the zero minutes and seconds of "15m0s" or "1h0m0s".
+func formatInterval(interval time.Duration) string {
+	if interval == 0 {
+		return ""
+	}
+	value := interval.String()
+	if strings.HasSuffix(value, "m0s") {
+		value = strings.TrimSuffix(value, "0s")
+	}
+	if strings.HasSuffix(value, "h0m") {
+		value = strings.TrimSuffix(value, "0m")
+	}
+	return value
+}
+
+// sourceSlugTaken reports whether a source other than the one with id uses
+// slug.
+func sourceSlugTaken(slug string, id int64) bool {
+	for _, source := range DbListSource() {
+		if source.Slug == slug && source.ID != id {
+			return true
+		}
+	}
+	return false
+}
+
+// saveSource stores the settings of a source, resetting its fetch state when
+// the URL changed from oldURL.
+func saveSource(source *Source, oldURL string) error {
+	err := DbUpdateSource(source)
+	if err != nil {
+		return err
+	}
+	if source.URL != oldURL {
+		// fetch state belongs to the old url
+		source.ETag, source.LastModified, source.ContentHash = "", "", ""
+		source.UpstreamInterval, source.FailureCount, source.LastError = 0, 0, ""
+		source.LastFetchedAt, source.NextFetchAt, source.ParsedAt = time.Time{}, time.Time{}, time.Time{}
+		return DbUpdateSourceFetchState(source)
+	}
+	return nil
+}
+
+// deleteSource removes a source along with its items.
+func deleteSource(id int64) error {
+	err := DbDeleteSource(id)
+	if err != nil {
+		return err
+	}
+	_, err = DbDeleteItemsBySource(id)
+	return err
+}
+
 func confirmDeleteSourceHandler(w http.ResponseWriter, r *http.Request) {
 
 	ctx := r.Context()
@@ -339,7 +707,7 @@ func confirmDeleteSourceHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := renderTemplate(w, "delete_source.html", map[string]interface{}{
+	err := renderTemplate(w, r, "delete_source.html", map[string]interface{}{
 		"source": source,
 	})
 	if err != nil {
@@ -357,13 +725,7 @@ func deleteSourceHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := DbDeleteSource(source.ID)
-	if err != nil {
-		http.Error(w, http.StatusText(500), 500)
-		return
-	}
-
-	_, err = DbDeleteItemsBySource(source.ID)
+	err := deleteSource(source.ID)
 	if err != nil {
 		http.Error(w, http.StatusText(500), 500)
 		return
@@ -392,10 +754,23 @@ func getFeedItemsHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(422), 422)
 		return
 	}
+	removed, err := DbListRemovedItems(source.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	overrides, err := itemOverrides()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	err = renderTemplate(w, "view_feed_items.html", map[string]interface{}{
-		"source": source,
-		"items":  items,
+	err = renderTemplate(w, r, "view_feed_items.html", map[string]interface{}{
+		"source":    source,
+		"items":     items,
+		"removed":   removed,
+		"overrides": overrides,
+		"message":   ctx.Value("flash"),
 	})
 	if err != nil {
 		fmt.Printf("\nRender Error: %v\n", err)
@@ -403,6 +778,26 @@ func getFeedItemsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// restoreItemHandler serves an item removed upstream again.
+func restoreItemHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	source := ctx.Value("source").(Source)
+	item := ctx.Value("item").(Item)
+
+	err := DbRestoreItem(item.ID)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	err = saveFlash(w, r, fmt.Sprintf("item id: %d restored", item.ID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/feeds/%d/items", source.ID), http.StatusSeeOther)
+}
+
 func refreshFeedItemsHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	source, ok := ctx.Value("source").(Source)
@@ -412,6 +807,9 @@ func refreshFeedItemsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// a manual refresh always downloads and parses the feed again
+	source.ETag, source.LastModified, source.ContentHash = "", "", ""
+
 	log.Printf("updating feed items. source=%d, slug=%s", source.ID, source.Slug)
 	err := fetcher.UpdateFeed(&source)
 	if err != nil {
@@ -427,6 +825,59 @@ func refreshFeedItemsHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, fmt.Sprintf("/feeds/%d/items", source.ID), http.StatusSeeOther)
 }
 
+// sourceStateHandler enables, disables, pauses or resumes a source, as told
+// by the action field. Pausing takes a duration in the pause field.
+func sourceStateHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	source, ok := ctx.Value("source").(Source)
+
+	if !ok {
+		http.Error(w, http.StatusText(422), 422)
+		return
+	}
+
+	r.ParseForm()
+	var message string
+	switch r.Form.Get("action") {
+	case "enable":
+		source.Enabled = true
+		source.HideItems = false
+		message = fmt.Sprintf("source id: %d enabled", source.ID)
+	case "disable":
+		source.Enabled = false
+		source.HideItems = r.Form.Get("hide-items") != ""
+		message = fmt.Sprintf("source id: %d disabled", source.ID)
+	case "pause":
+		d, err := time.ParseDuration(r.Form.Get("pause"))
+		if err != nil || d <= 0 {
+			w.Write([]byte(fmt.Sprintf("invalid pause duration")))
+			return
+		}
+		source.PausedUntil = time.Now().Add(d)
+		message = fmt.Sprintf("source id: %d paused until %s", source.ID, source.PausedUntil.Format("2006-01-02 15:04:05"))
+	case "resume":
+		source.PausedUntil = time.Time{}
+		message = fmt.Sprintf("source id: %d resumed", source.ID)
+	default:
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+
+	err := DbUpdateSourceState(&source)
+	if err != nil {
+		log.Printf("cannot update source, err=%s", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	err = saveFlash(w, r, message)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/feeds", http.StatusSeeOther)
+}
+
 func renderText(w http.ResponseWriter, tmpl string, param map[string]interface{}) error {
 	templateBytes, err := templates.TemplateBox.ReadFile(tmpl)
 	if err != nil {
@@ -442,7 +893,12 @@ func renderText(w http.ResponseWriter, tmpl string, param map[string]interface{}
 	return tmplMessage.Execute(w, param)
 }
 
-func renderTemplate(w http.ResponseWriter, tmpl string, param map[string]interface{}) error {
+func renderTemplate(w http.ResponseWriter, r *http.Request, tmpl string, param map[string]interface{}) error {
+	// forms send the token back to CSRFMiddleware
+	if token, ok := r.Context().Value("csrfToken").(string); ok {
+		param["csrfToken"] = token
+	}
+
 	// get file contents as string
 	templateBytes, err := templates.TemplateBox.ReadFile(tmpl)
 	if err != nil {
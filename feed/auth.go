@@ -0,0 +1,131 @@
+package feed
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// sessionUserKey is the session value holding the name of the signed in
+// admin.
+const sessionUserKey = "user"
+
+// sessionMaxAge is how long an admin stays signed in, in seconds.
+const sessionMaxAge = 7 * 24 * 60 * 60
+
+// validateCredentials checks that the admin credentials are configured.
+func validateCredentials(server ServerConfig) error {
+	if server.Username == "" || server.Password == "" {
+		return fmt.Errorf("server username and password are required")
+	}
+	if !isBcryptHash(server.Password) {
+		log.Println("server password is stored in plain text, consider a bcrypt hash")
+	}
+	return nil
+}
+
+func isBcryptHash(password string) bool {
+	return strings.HasPrefix(password, "$2a$") || strings.HasPrefix(password, "$2b$") || strings.HasPrefix(password, "$2y$")
+}
+
+// checkCredentials compares a login attempt with the configured admin, the
+// password may be configured as a bcrypt hash or in plain text.
+func checkCredentials(username string, password string) bool {
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(cfg.Server.Username)) == 1
+	var passwordOK bool
+	if isBcryptHash(cfg.Server.Password) {
+		passwordOK = bcrypt.CompareHashAndPassword([]byte(cfg.Server.Password), []byte(password)) == nil
+	} else {
+		passwordOK = subtle.ConstantTimeCompare([]byte(password), []byte(cfg.Server.Password)) == 1
+	}
+	return userOK && passwordOK
+}
+
+// signedIn reports whether the request carries the session of the admin.
+func signedIn(r *http.Request) bool {
+	session, err := store.Get(r, SESSION_NAME)
+	if err != nil {
+		return false
+	}
+	user, ok := session.Values[sessionUserKey].(string)
+	return ok && user == cfg.Server.Username
+}
+
+// AuthMiddleware lets only the signed in admin through, browsers are sent to
+// the login page.
+func AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if signedIn(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(401), 401)
+			return
+		}
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+	})
+}
+
+// safeNext returns the page to go to after signing in, only local paths are
+// accepted.
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/feeds"
+	}
+	return next
+}
+
+func loginFormHandler(w http.ResponseWriter, r *http.Request) {
+	renderLogin(w, r, safeNext(r.URL.Query().Get("next")), "")
+}
+
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	next := safeNext(r.Form.Get("next"))
+
+	if !checkCredentials(r.Form.Get("username"), r.Form.Get("password")) {
+		log.Printf("failed login, username=%s", r.Form.Get("username"))
+		w.WriteHeader(http.StatusUnauthorized)
+		renderLogin(w, r, next, "Invalid username or password")
+		return
+	}
+
+	session, _ := store.Get(r, SESSION_NAME)
+	session.Values[sessionUserKey] = cfg.Server.Username
+	err := session.Save(r, w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, SESSION_NAME)
+	delete(session.Values, sessionUserKey)
+	session.Options.MaxAge = -1
+	err := session.Save(r, w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func renderLogin(w http.ResponseWriter, r *http.Request, next string, message string) {
+	err := renderTemplate(w, r, "login.html", map[string]interface{}{
+		"next":    next,
+		"message": message,
+	})
+	if err != nil {
+		fmt.Printf("\nRender Error: %v\n", err)
+		return
+	}
+}
@@ -0,0 +1,293 @@
+package feed
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"gopkg.in/yaml.v2"
+)
+
+func channelFeedHandler(w http.ResponseWriter, r *http.Request) {
+	channel, err := DbGetChannelBySlug(chi.URLParam(r, "channelSlug"))
+	if err == ErrNotFound {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	d, err := DbGetItemsForChannel(&channel, 0, 9999)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	d, _, err = selectChannelItems(channel, d, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	options := cfg.Channels[channel.Slug]
+	channel.Rules = options.Rules
+	channel.Trackers = options.Trackers
+	renderFeed(w, r, channel.ChannelConfig, capFeedItems(d))
+}
+
+func previewChannelHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	channel := ctx.Value("channel").(Channel)
+
+	d, err := DbGetItemsForChannel(&channel, 0, 9999)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	renderPreview(w, r, channel, d)
+}
+
+func ChannelCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		channelID := chi.URLParam(r, "channelID")
+		cid, err := strconv.ParseInt(channelID, 10, 64)
+		if err != nil {
+			http.Error(w, http.StatusText(400), 400)
+			return
+		}
+		channel, err := DbGetChannel(cid)
+		if err != nil {
+			http.Error(w, http.StatusText(404), 404)
+			return
+		}
+		ctx := context.WithValue(r.Context(), "channel", channel)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func listChannelsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	flash := ctx.Value("flash")
+
+	channels, err := DbListChannel()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = renderTemplate(w, r, "channels.html", map[string]interface{}{
+		"channels": channels,
+		"message":  flash,
+	})
+	if err != nil {
+		fmt.Printf("\nRender Error: %v\n", err)
+		return
+	}
+}
+
+func createChannelHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	channel, err := channelFromForm(r, 0)
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	err = DbCreateChannel(&channel)
+	if err != nil {
+		log.Printf("cannot create channel, err=%s", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	err = saveFlash(w, r, fmt.Sprintf("new channel added, id=%d", channel.ID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/feeds/channels/%d/edit", channel.ID), http.StatusSeeOther)
+}
+
+func updateChannelFormHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	channel, ok := ctx.Value("channel").(Channel)
+	if !ok {
+		http.Error(w, http.StatusText(422), 422)
+		return
+	}
+
+	sourceIDs, err := DbGetChannelSourceIDs(channel.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	members := make(map[int64]bool)
+	for _, id := range sourceIDs {
+		members[id] = true
+	}
+
+	var filters string
+	if len(channel.Filters) > 0 {
+		out, err := yaml.Marshal(channel.Filters)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		filters = string(out)
+	}
+
+	err = renderTemplate(w, r, "edit_channel.html", map[string]interface{}{
+		"channel": channel,
+		"filters": filters,
+		"sources": DbListSource(),
+		"members": members,
+		"message": ctx.Value("flash"),
+	})
+	if err != nil {
+		fmt.Printf("\nRender Error: %v\n", err)
+		return
+	}
+}
+
+func updateChannelHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	channel, ok := ctx.Value("channel").(Channel)
+	if !ok {
+		http.Error(w, http.StatusText(422), 422)
+		return
+	}
+
+	r.ParseForm()
+	newChannel, err := channelFromForm(r, channel.ID)
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	var sourceIDs []int64
+	for _, value := range r.Form["source"] {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			w.Write([]byte(fmt.Sprintf("invalid source id %q", value)))
+			return
+		}
+		sourceIDs = append(sourceIDs, id)
+	}
+
+	err = DbUpdateChannel(&newChannel)
+	if err != nil {
+		log.Printf("cannot update channel, err=%s", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	forgetChannelFilters(channel.ID)
+
+	err = DbSetChannelSources(channel.ID, sourceIDs)
+	if err != nil {
+		log.Printf("cannot update channel sources, err=%s", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	err = saveFlash(w, r, fmt.Sprintf("channel id: %d updated", channel.ID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/feeds/channels", http.StatusSeeOther)
+}
+
+func confirmDeleteChannelHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	channel, ok := ctx.Value("channel").(Channel)
+	if !ok {
+		http.Error(w, http.StatusText(422), 422)
+		return
+	}
+
+	err := renderTemplate(w, r, "delete_channel.html", map[string]interface{}{
+		"channel": channel,
+	})
+	if err != nil {
+		fmt.Printf("\nRender Error: %v\n", err)
+		return
+	}
+}
+
+func deleteChannelHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	channel, ok := ctx.Value("channel").(Channel)
+	if !ok {
+		http.Error(w, http.StatusText(422), 422)
+		return
+	}
+
+	err := DbDeleteChannel(channel.ID)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	forgetChannelFilters(channel.ID)
+
+	err = saveFlash(w, r, fmt.Sprintf("channel id: %d deleted", channel.ID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/feeds/channels", http.StatusSeeOther)
+}
+
+// channelFromForm reads a channel from the admin form, id is zero for new
+// channels. Slugs must be unique as they are part of the channel url. Filters
+// are written in YAML, as in the configuration file.
+func channelFromForm(r *http.Request, id int64) (Channel, error) {
+	channel := Channel{
+		ID:         id,
+		Slug:       r.Form.Get("slug"),
+		AllSources: r.Form.Get("all-sources") != "",
+		ChannelConfig: ChannelConfig{
+			Title:          r.Form.Get("title"),
+			Description:    r.Form.Get("description"),
+			Category:       r.Form.Get("category"),
+			Link:           r.Form.Get("link"),
+			Author:         r.Form.Get("author"),
+			Copyright:      r.Form.Get("copyright"),
+			Email:          r.Form.Get("email"),
+			Language:       r.Form.Get("language"),
+			PermaLink:      r.Form.Get("permalink"),
+			FeedLink:       r.Form.Get("feedlink"),
+			Explicit:       r.Form.Get("explicit"),
+			CoverURL:       r.Form.Get("cover-url"),
+			TrackingPrefix: r.Form.Get("tracking-prefix"),
+			TrackDownloads: r.Form.Get("track-downloads") != "",
+		},
+	}
+
+	if channel.Slug == "" {
+		return channel, fmt.Errorf("slug is required")
+	}
+	if channel.Title == "" {
+		return channel, fmt.Errorf("title is required")
+	}
+	if filters := strings.TrimSpace(r.Form.Get("filters")); filters != "" {
+		if err := yaml.UnmarshalStrict([]byte(filters), &channel.Filters); err != nil {
+			return channel, fmt.Errorf("invalid filters, %v", err)
+		}
+		if _, err := compileFilters(channel.Filters, "channel "+channel.Slug); err != nil {
+			return channel, fmt.Errorf("invalid filters, %v", err)
+		}
+	}
+
+	existing, err := DbGetChannelBySlug(channel.Slug)
+	if err == nil && existing.ID != id {
+		return channel, fmt.Errorf("slug %s is already used", channel.Slug)
+	}
+	if err != nil && err != ErrNotFound {
+		return channel, err
+	}
+	return channel, nil
+}
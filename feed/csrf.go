@@ -0,0 +1,71 @@
+package feed
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net/http"
+)
+
+const (
+	// sessionCSRFKey is the session value holding the CSRF token
+	sessionCSRFKey = "csrf"
+	// csrfFormField and csrfHeader carry the token of a request
+	csrfFormField = "csrf_token"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+// CSRFMiddleware gives every session a CSRF token, made available to
+// templates as csrfToken, and rejects state-changing requests that do not
+// send it back.
+func CSRFMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, err := store.Get(r, SESSION_NAME)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		token, ok := session.Values[sessionCSRFKey].(string)
+		if !ok || token == "" {
+			token, err = newCSRFToken()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			session.Values[sessionCSRFKey] = token
+			err = session.Save(r, w)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			sent := r.Header.Get(csrfHeader)
+			if sent == "" {
+				sent = r.PostFormValue(csrfFormField)
+			}
+			if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+				log.Printf("rejected request without a valid csrf token, %s %s", r.Method, r.URL.Path)
+				http.Error(w, http.StatusText(403), 403)
+				return
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), "csrfToken", token)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func newCSRFToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
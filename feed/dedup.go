@@ -0,0 +1,294 @@
+package feed
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/wiennat/rjio/pkg/feedfmt"
+)
+
+// Ways of matching the copies of an episode published by several sources.
+const (
+	DedupGUID      = "guid"
+	DedupEnclosure = "enclosure"
+	DedupTitle     = "title"
+)
+
+const (
+	defaultTitleSimilarity = 0.8
+	defaultTitleWindow     = 48 * time.Hour
+)
+
+// DedupConfig enables the deduplication of items across sources. Items match
+// by GUID, by enclosure URL once trackers are stripped, or by similar titles
+// published within TitleWindow of each other. The copy from the source with
+// the highest priority is served.
+type DedupConfig struct {
+	By []string `yaml:"by"`
+	// TitleSimilarity is the share of words two titles must have in common,
+	// between 0 and 1
+	TitleSimilarity float64       `yaml:"title-similarity"`
+	TitleWindow     time.Duration `yaml:"title-window"`
+}
+
+// Duplicate is an item left out as a copy of another one.
+type Duplicate struct {
+	Item
+	Of Item
+	By string
+}
+
+func validateDedup(config DedupConfig) error {
+	for _, by := range config.By {
+		switch by {
+		case DedupGUID, DedupEnclosure, DedupTitle:
+		default:
+			return fmt.Errorf("unknown dedup method %s", by)
+		}
+	}
+	if config.TitleSimilarity < 0 || config.TitleSimilarity > 1 {
+		return fmt.Errorf("title-similarity must be between 0 and 1")
+	}
+	if config.TitleWindow < 0 {
+		return fmt.Errorf("title-window cannot be negative")
+	}
+	return nil
+}
+
+type dedupKeys struct {
+	guid      string
+	enclosure string
+	words     map[string]bool
+}
+
+func dedupKeysOf(item *Item) dedupKeys {
+	keys := dedupKeys{guid: strings.TrimSpace(item.GUID)}
+	if item.EnclosureUrl != "" {
+		keys.enclosure = feedfmt.NormalizeEnclosureURL(item.EnclosureUrl)
+	}
+	words := strings.FieldsFunc(strings.ToLower(item.Title), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsNumber(c)
+	})
+	if len(words) > 0 {
+		keys.words = make(map[string]bool, len(words))
+		for _, w := range words {
+			keys.words[w] = true
+		}
+	}
+	return keys
+}
+
+// titleBucket is the time slot of width window a publication date falls in,
+// items published within window of each other are in the same or adjacent
+// slots.
+func titleBucket(pubDate time.Time, window time.Duration) int64 {
+	width := int64(window / time.Second)
+	if width < 1 {
+		width = 1
+	}
+	t := pubDate.Unix()
+	if t < 0 {
+		return (t+1)/width - 1
+	}
+	return t / width
+}
+
+// titleSimilarity is the Jaccard index of the words of two titles.
+func titleSimilarity(a map[string]bool, b map[string]bool) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	common := 0
+	for w := range a {
+		if b[w] {
+			common++
+		}
+	}
+	return float64(common) / float64(len(a)+len(b)-common)
+}
+
+// sourcePriorities maps source ids to their configured priority.
+func sourcePriorities() map[int64]int {
+	priorities := make(map[int64]int)
+	if len(cfg.Sources) == 0 {
+		return priorities
+	}
+	for _, source := range DbListSource() {
+		priorities[source.ID] = cfg.Sources[source.Slug].Priority
+	}
+	return priorities
+}
+
+// dedupItems leaves out the copies of an episode published by several
+// sources as configured, keeping the order of items.
+func dedupItems(items []Item) ([]Item, []Duplicate) {
+	if len(cfg.Dedup.By) == 0 || len(items) < 2 {
+		return items, nil
+	}
+	return findDuplicates(items, cfg.Dedup, sourcePriorities())
+}
+
+// findDuplicates leaves out the copies of an episode published by several
+// sources, the copy from the source with the highest priority in priorities
+// wins. Copies within a source are left to UpsertSourceItem.
+func findDuplicates(items []Item, config DedupConfig, priorities map[int64]int) ([]Item, []Duplicate) {
+	if len(config.By) == 0 || len(items) < 2 {
+		return items, nil
+	}
+	similarity := config.TitleSimilarity
+	if similarity == 0 {
+		similarity = defaultTitleSimilarity
+	}
+	window := config.TitleWindow
+	if window == 0 {
+		window = defaultTitleWindow
+	}
+
+	// visit the copies that win first: higher priority, then first seen
+	order := make([]int, len(items))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := &items[order[i]], &items[order[j]]
+		if priorities[a.FeedID] != priorities[b.FeedID] {
+			return priorities[a.FeedID] > priorities[b.FeedID]
+		}
+		return a.FirstSeenAt.Before(b.FirstSeenAt)
+	})
+
+	keys := make([]dedupKeys, len(items))
+	for i := range items {
+		keys[i] = dedupKeysOf(&items[i])
+	}
+
+	byGUID := make(map[string]int)
+	byEnclosure := make(map[string]int)
+	// kept items by title bucket, in the order they were kept
+	byBucket := make(map[int64][]int)
+	rank := make(map[int]int)
+	var kept []int
+	duplicateOf := make(map[int]Duplicate)
+	for _, i := range order {
+		match, by := -1, ""
+		for _, method := range config.By {
+			switch method {
+			case DedupGUID:
+				if j, ok := byGUID[keys[i].guid]; ok && keys[i].guid != "" {
+					match = j
+				}
+			case DedupEnclosure:
+				if j, ok := byEnclosure[keys[i].enclosure]; ok && keys[i].enclosure != "" {
+					match = j
+				}
+			case DedupTitle:
+				// match the first kept item, only looking at those published
+				// around the same time
+				bucket := titleBucket(items[i].PubDate, window)
+				for b := bucket - 1; b <= bucket+1; b++ {
+					for _, j := range byBucket[b] {
+						if match >= 0 && rank[j] > rank[match] {
+							break
+						}
+						if items[j].FeedID == items[i].FeedID {
+							continue
+						}
+						d := items[i].PubDate.Sub(items[j].PubDate)
+						if d < -window || d > window {
+							continue
+						}
+						if titleSimilarity(keys[i].words, keys[j].words) >= similarity {
+							match = j
+							break
+						}
+					}
+				}
+			}
+			if match >= 0 && items[match].FeedID != items[i].FeedID {
+				by = method
+				break
+			}
+			match = -1
+		}
+
+		if match >= 0 {
+			duplicateOf[i] = Duplicate{Item: items[i], Of: items[match], By: by}
+			continue
+		}
+		rank[i] = len(kept)
+		kept = append(kept, i)
+		if len(keys[i].words) > 0 {
+			bucket := titleBucket(items[i].PubDate, window)
+			byBucket[bucket] = append(byBucket[bucket], i)
+		}
+		if keys[i].guid != "" {
+			if _, ok := byGUID[keys[i].guid]; !ok {
+				byGUID[keys[i].guid] = i
+			}
+		}
+		if keys[i].enclosure != "" {
+			if _, ok := byEnclosure[keys[i].enclosure]; !ok {
+				byEnclosure[keys[i].enclosure] = i
+			}
+		}
+	}
+
+	result := make([]Item, 0, len(kept))
+	var duplicates []Duplicate
+	for i, item := range items {
+		if d, ok := duplicateOf[i]; ok {
+			duplicates = append(duplicates, d)
+			continue
+		}
+		result = append(result, item)
+	}
+	return result, duplicates
+}
+
+// duplicateRulePrefix starts the rule of the items left out as duplicates.
+const duplicateRulePrefix = "duplicate of "
+
+// duplicateRule describes why a duplicate is left out of a channel.
+func duplicateRule(d Duplicate) string {
+	return fmt.Sprintf("%sitem %d (%s)", duplicateRulePrefix, d.Of.ID, d.By)
+}
+
+// duplicatesHandler reports the items of the default channel left out as
+// copies of items of other sources, as they are left out of the feed.
+func duplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	d, err := DbGetItemsForCustomFeed(0, 9999)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, dropped, err := selectChannelItems(defaultChannel(), d, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var duplicates []FilteredItem
+	for _, item := range dropped {
+		if strings.HasPrefix(item.Rule, duplicateRulePrefix) {
+			duplicates = append(duplicates, item)
+		}
+	}
+
+	names := make(map[int64]string)
+	for _, source := range DbListSource() {
+		names[source.ID] = source.Name
+	}
+
+	err = renderTemplate(w, r, "duplicates.html", map[string]interface{}{
+		"enabled":    len(cfg.Dedup.By) > 0,
+		"duplicates": duplicates,
+		"names":      names,
+	})
+	if err != nil {
+		fmt.Printf("\nRender Error: %v\n", err)
+		return
+	}
+}
@@ -0,0 +1,237 @@
+package feed
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func dedupItem(id int64, feedID int64, guid string, enclosureURL string, title string, pubDate time.Time) Item {
+	item := Item{ID: id, FeedID: feedID, FirstSeenAt: pubDate}
+	item.GUID = guid
+	item.EnclosureUrl = enclosureURL
+	item.Title = title
+	item.PubDate = pubDate
+	return item
+}
+
+func TestFindDuplicates(t *testing.T) {
+	now := time.Date(2023, 1, 10, 12, 0, 0, 0, time.UTC)
+	hour := time.Hour
+	// a bucket of an hour ends on the hour
+	edge := time.Date(2023, 1, 10, 13, 0, 0, 0, time.UTC)
+	epoch := time.Unix(0, 0).UTC()
+
+	tests := []struct {
+		name       string
+		items      []Item
+		config     DedupConfig
+		priorities map[int64]int
+		kept       []int64
+		// duplicates as "item of other by method"
+		duplicates []string
+	}{
+		{
+			name: "no methods",
+			items: []Item{
+				dedupItem(1, 1, "a", "", "", now),
+				dedupItem(2, 2, "a", "", "", now),
+			},
+			kept: []int64{1, 2},
+		},
+		{
+			name: "first seen wins",
+			items: []Item{
+				dedupItem(1, 1, "a", "", "", now),
+				dedupItem(2, 2, "a", "", "", now.Add(-hour)),
+			},
+			config:     DedupConfig{By: []string{DedupGUID}},
+			kept:       []int64{2},
+			duplicates: []string{"1 of 2 by guid"},
+		},
+		{
+			name: "priority wins",
+			items: []Item{
+				dedupItem(1, 1, "a", "", "", now.Add(-hour)),
+				dedupItem(2, 2, "a", "", "", now),
+				dedupItem(3, 3, "a", "", "", now.Add(-2*hour)),
+			},
+			config:     DedupConfig{By: []string{DedupGUID}},
+			priorities: map[int64]int{2: 10, 3: 5},
+			kept:       []int64{2},
+			duplicates: []string{"1 of 2 by guid", "3 of 2 by guid"},
+		},
+		{
+			name: "copies within a source are kept",
+			items: []Item{
+				dedupItem(1, 1, "a", "https://cdn.example.com/1.mp3", "Episode 1", now),
+				dedupItem(2, 1, "a", "https://cdn.example.com/1.mp3", "Episode 1", now),
+			},
+			config: DedupConfig{By: []string{DedupGUID, DedupEnclosure, DedupTitle}},
+			kept:   []int64{1, 2},
+		},
+		{
+			name: "copy of an item kept within its source",
+			items: []Item{
+				dedupItem(1, 1, "a", "", "", now.Add(-hour)),
+				dedupItem(2, 1, "a", "", "", now),
+				dedupItem(3, 2, "a", "", "", now),
+			},
+			config:     DedupConfig{By: []string{DedupGUID}},
+			kept:       []int64{1, 2},
+			duplicates: []string{"3 of 1 by guid"},
+		},
+		{
+			name: "enclosure through trackers",
+			items: []Item{
+				dedupItem(1, 1, "a", "https://dts.podtrac.com/redirect.mp3/cdn.example.com/1.mp3?t=1", "", now),
+				dedupItem(2, 2, "b", "https://www.cdn.example.com/1.mp3", "", now.Add(hour)),
+				dedupItem(3, 3, "c", "https://cdn.example.com/2.mp3", "", now.Add(hour)),
+			},
+			config:     DedupConfig{By: []string{DedupGUID, DedupEnclosure}},
+			kept:       []int64{1, 3},
+			duplicates: []string{"2 of 1 by enclosure"},
+		},
+		{
+			name: "empty keys do not match",
+			items: []Item{
+				dedupItem(1, 1, "", "", "", now),
+				dedupItem(2, 2, "", "", "", now),
+			},
+			config: DedupConfig{By: []string{DedupGUID, DedupEnclosure, DedupTitle}},
+			kept:   []int64{1, 2},
+		},
+		{
+			name: "first method that matches",
+			items: []Item{
+				dedupItem(1, 1, "a", "https://cdn.example.com/1.mp3", "Episode 1", now),
+				dedupItem(2, 2, "b", "https://cdn.example.com/1.mp3", "Episode 1", now.Add(hour)),
+			},
+			config:     DedupConfig{By: []string{DedupTitle, DedupEnclosure}},
+			kept:       []int64{1},
+			duplicates: []string{"2 of 1 by title"},
+		},
+		{
+			name: "similar titles",
+			items: []Item{
+				dedupItem(1, 1, "a", "", "The Show #12: Cats", now),
+				dedupItem(2, 2, "b", "", "the show 12 - cats", now.Add(hour)),
+				dedupItem(3, 3, "c", "", "The Show #13: Dogs", now.Add(hour)),
+			},
+			config:     DedupConfig{By: []string{DedupTitle}},
+			kept:       []int64{1, 3},
+			duplicates: []string{"2 of 1 by title"},
+		},
+		{
+			name: "title similarity",
+			items: []Item{
+				dedupItem(1, 1, "a", "", "one two three four", now),
+				dedupItem(2, 2, "b", "", "one two three five", now),
+			},
+			config:     DedupConfig{By: []string{DedupTitle}, TitleSimilarity: 0.6},
+			kept:       []int64{1},
+			duplicates: []string{"2 of 1 by title"},
+		},
+		{
+			name: "titles across a bucket edge",
+			items: []Item{
+				dedupItem(1, 1, "a", "", "Episode 1", edge.Add(-time.Second)),
+				dedupItem(2, 2, "b", "", "Episode 1", edge.Add(30*time.Second)),
+			},
+			config:     DedupConfig{By: []string{DedupTitle}, TitleWindow: hour},
+			kept:       []int64{1},
+			duplicates: []string{"2 of 1 by title"},
+		},
+		{
+			name: "titles just outside the window",
+			items: []Item{
+				dedupItem(1, 1, "a", "", "Episode 1", edge.Add(-time.Second)),
+				dedupItem(2, 2, "b", "", "Episode 1", edge.Add(hour)),
+			},
+			config: DedupConfig{By: []string{DedupTitle}, TitleWindow: hour},
+			kept:   []int64{1, 2},
+		},
+		{
+			name: "titles at the window",
+			items: []Item{
+				dedupItem(1, 1, "a", "", "Episode 1", edge),
+				dedupItem(2, 2, "b", "", "Episode 1", edge.Add(-hour)),
+			},
+			config:     DedupConfig{By: []string{DedupTitle}, TitleWindow: hour},
+			kept:       []int64{2},
+			duplicates: []string{"1 of 2 by title"},
+		},
+		{
+			name: "titles two buckets apart",
+			items: []Item{
+				dedupItem(1, 1, "a", "", "Episode 1", edge.Add(-hour)),
+				dedupItem(2, 2, "b", "", "Episode 1", edge.Add(hour)),
+			},
+			config: DedupConfig{By: []string{DedupTitle}, TitleWindow: hour},
+			kept:   []int64{1, 2},
+		},
+		{
+			name: "title matches the first kept item",
+			items: []Item{
+				dedupItem(1, 1, "a", "", "Episode 1", edge.Add(50*time.Minute)),
+				dedupItem(2, 2, "b", "", "Episode 1", edge.Add(-50*time.Minute)),
+				dedupItem(3, 3, "c", "", "Episode 1", edge),
+			},
+			config:     DedupConfig{By: []string{DedupTitle}, TitleWindow: hour},
+			priorities: map[int64]int{1: 3, 2: 2},
+			kept:       []int64{1, 2},
+			duplicates: []string{"3 of 1 by title"},
+		},
+		{
+			name: "titles around the epoch",
+			items: []Item{
+				dedupItem(1, 1, "a", "", "Episode 1", epoch.Add(-30*time.Second)),
+				dedupItem(2, 2, "b", "", "Episode 1", epoch.Add(30*time.Second)),
+				dedupItem(3, 3, "c", "", "Episode 1", epoch.Add(-3*time.Minute)),
+			},
+			config:     DedupConfig{By: []string{DedupTitle}, TitleWindow: time.Minute},
+			kept:       []int64{1, 3},
+			duplicates: []string{"2 of 1 by title"},
+		},
+	}
+	for _, tt := range tests {
+		kept, duplicates := findDuplicates(tt.items, tt.config, tt.priorities)
+		var keptIDs []int64
+		for _, item := range kept {
+			keptIDs = append(keptIDs, item.ID)
+		}
+		if !reflect.DeepEqual(keptIDs, tt.kept) {
+			t.Errorf("%s: kept %v, want %v", tt.name, keptIDs, tt.kept)
+		}
+		var got []string
+		for _, d := range duplicates {
+			got = append(got, fmt.Sprintf("%d of %d by %s", d.ID, d.Of.ID, d.By))
+		}
+		if !reflect.DeepEqual(got, tt.duplicates) {
+			t.Errorf("%s: duplicates %v, want %v", tt.name, got, tt.duplicates)
+		}
+	}
+}
+
+func TestTitleBucket(t *testing.T) {
+	tests := []struct {
+		unix   int64
+		window time.Duration
+		bucket int64
+	}{
+		{0, time.Minute, 0},
+		{59, time.Minute, 0},
+		{60, time.Minute, 1},
+		{-1, time.Minute, -1},
+		{-60, time.Minute, -1},
+		{-61, time.Minute, -2},
+		{-1, 0, -1},
+		{5, time.Millisecond, 5},
+	}
+	for _, tt := range tests {
+		if got := titleBucket(time.Unix(tt.unix, 0), tt.window); got != tt.bucket {
+			t.Errorf("titleBucket(%d, %v) = %d, want %d", tt.unix, tt.window, got, tt.bucket)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package feed
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// downloadRewriter points the enclosure of an item to its download URL,
+// leaving the other enclosures of the item as they are since the tracker only
+// redirects to the first one.
+type downloadRewriter struct {
+	enclosureURL string
+	downloadURL  string
+}
+
+func (d downloadRewriter) RewriteEnclosure(enclosureURL string) (string, error) {
+	if enclosureURL != d.enclosureURL {
+		return enclosureURL, nil
+	}
+	return d.downloadURL, nil
+}
+
+// downloadURL is the address of the built-in tracker for the enclosure of
+// item. The file name is only there for podcast apps that look at it.
+func downloadURL(base string, item Item) string {
+	filename := "enclosure"
+	if u, err := url.Parse(item.EnclosureUrl); err == nil && path.Base(u.Path) != "/" && path.Base(u.Path) != "." {
+		filename = path.Base(u.Path)
+	}
+	return fmt.Sprintf("%s/e/%d/%s", base, item.ID, url.PathEscape(filename))
+}
+
+// applyDownloadTracking rewrites the enclosures of items to go through the
+// built-in tracker. Items that cannot be rewritten are logged and served with
+// their direct enclosures.
+func applyDownloadTracking(items []Item, base string) []Item {
+	for i, item := range items {
+		if item.EnclosureUrl == "" {
+			continue
+		}
+		err := items[i].RewriteEnclosures(downloadRewriter{item.EnclosureUrl, downloadURL(base, item)})
+		if err != nil {
+			log.Printf("Serving item without download tracking, err=%v", err)
+		}
+	}
+	return items
+}
+
+// downloadHandler records a download and redirects to the original
+// enclosure.
+func downloadHandler(w http.ResponseWriter, r *http.Request) {
+	itemID, err := strconv.ParseInt(chi.URLParam(r, "itemID"), 10, 64)
+	if err != nil {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+	item, err := DbGetItem(itemID)
+	if err == ErrNotFound || (err == nil && item.EnclosureUrl == "") {
+		http.Error(w, http.StatusText(404), 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		hit := Hit{
+			ItemID:    item.ID,
+			SourceID:  item.FeedID,
+			CreatedAt: time.Now(),
+			IPHash:    hashIP(r.RemoteAddr),
+			UserAgent: r.UserAgent(),
+			Range:     r.Header.Get("Range"),
+			Referer:   r.Referer(),
+		}
+		if err := DbCreateHit(&hit); err != nil {
+			// never fail a download because of the statistics
+			log.Printf("cannot record hit for item %d, err=%v", item.ID, err)
+		}
+	}
+
+	http.Redirect(w, r, item.EnclosureUrl, http.StatusFound)
+}
+
+// hashIP hashes the client address keyed with the session key, so hits can
+// be told apart without keeping addresses.
+func hashIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	mac := hmac.New(sha256.New, []byte(cfg.Server.SessionKey))
+	mac.Write([]byte(host))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -1,89 +1,317 @@
 package feed
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/antchfx/xmlquery"
+
+	"github.com/wiennat/rjio/pkg/feedfmt"
 )
 
-var defaultLocation = time.FixedZone("GMT", 0)
-var defaultDate = time.Date(2001, time.January, 13, 18, 12, 23, 0, defaultLocation)
 var netClient = &http.Client{
 	Timeout: time.Second * 30,
 }
 
+const (
+	defaultTick            = time.Minute
+	defaultMaxBackoff      = 24 * time.Hour
+	defaultConcurrency     = 4
+	defaultHostConcurrency = 2
+	defaultRemovedAfter    = 3
+)
+
+// parserVersion is the version of the fields read from items, bumping it
+// parses unchanged feeds again so that stored items get the fields read since.
+const parserVersion = 1
+
 type FetcherConfig struct {
-	Interval time.Duration `yaml:"interval"`
+	// Interval is the default time between two fetches of a source
+	Interval        time.Duration `yaml:"interval"`
+	Tick            time.Duration `yaml:"tick"`
+	MaxBackoff      time.Duration `yaml:"max-backoff"`
+	Concurrency     int           `yaml:"concurrency"`
+	HostConcurrency int           `yaml:"host-concurrency"`
+	// RemovedAfter is the number of successful fetches in a row an item must
+	// be missing from before it is considered removed upstream. Removed items
+	// are left out of the feeds unless ServeRemoved is set.
+	RemovedAfter int  `yaml:"removed-after"`
+	ServeRemoved bool `yaml:"serve-removed"`
 }
+
 type Fetcher struct {
 	Config *Config
+	hosts  *hostLimiter
 }
 
 func NewFetcher(config *Config) *Fetcher {
-	return &Fetcher{Config: config}
+	hostConcurrency := config.Fetcher.HostConcurrency
+	if hostConcurrency <= 0 {
+		hostConcurrency = defaultHostConcurrency
+	}
+	for slug, source := range config.Sources {
+		if _, err := feedfmt.NewRewriter(source.Rules); err != nil {
+			log.Fatalf("invalid rules for source %s: %v", slug, err)
+		}
+	}
+
+	return &Fetcher{
+		Config: config,
+		hosts:  newHostLimiter(hostConcurrency),
+	}
 }
 
 func (f Fetcher) Start() {
 	go func() {
-		for range time.Tick(f.Config.Fetcher.Interval) {
+		for now := range time.Tick(f.tick()) {
 			log.Println("Fetching feed")
-			sources := DbListSource()
-			for _, v := range sources {
-				err := f.UpdateFeed(&v)
-				if err != nil {
-					log.Println(err)
+			var due []Source
+			for _, source := range DbListSource() {
+				if source.Active(now) && source.Due(now) {
+					due = append(due, source)
 				}
 			}
+			f.updateFeeds(due)
 			log.Println("Finish fetching loop")
 		}
 	}()
 }
 
+// updateFeeds fetches sources using a bounded pool of workers and returns
+// once all of them are done.
+func (f Fetcher) updateFeeds(sources []Source) {
+	concurrency := f.Config.Fetcher.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+
+	jobs := make(chan Source)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for source := range jobs {
+				err := f.UpdateFeed(&source)
+				if err != nil {
+					log.Println(err)
+				}
+			}
+		}()
+	}
+
+	for _, source := range interleaveHosts(sources) {
+		jobs <- source
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+func (f Fetcher) removedAfter() int {
+	if f.Config.Fetcher.RemovedAfter > 0 {
+		return f.Config.Fetcher.RemovedAfter
+	}
+	return defaultRemovedAfter
+}
+
+// interleaveHosts orders sources round-robin by host so that workers are not
+// all queued up behind the per-host limit of the same server.
+func interleaveHosts(sources []Source) []Source {
+	var hosts []string
+	byHost := make(map[string][]Source)
+	for _, source := range sources {
+		host := source.URL
+		if u, err := url.Parse(source.URL); err == nil {
+			host = u.Host
+		}
+		if _, ok := byHost[host]; !ok {
+			hosts = append(hosts, host)
+		}
+		byHost[host] = append(byHost[host], source)
+	}
+
+	ordered := make([]Source, 0, len(sources))
+	for len(ordered) < len(sources) {
+		for _, host := range hosts {
+			if queue := byHost[host]; len(queue) > 0 {
+				ordered = append(ordered, queue[0])
+				byHost[host] = queue[1:]
+			}
+		}
+	}
+	return ordered
+}
+
+// UpdateFeed fetches a source, stores its items and schedules the next fetch
+// based on the outcome.
 func (f Fetcher) UpdateFeed(source *Source) error {
+	err := f.fetchFeed(source)
+	now := time.Now()
+	f.schedule(source, err, now)
+
+	// items missing from the last parsed content are still missing when the
+	// feed is unchanged
+	if err == nil && !source.ParsedAt.IsZero() {
+		if merr := DbMarkMissingItems(source.ID, source.ParsedAt, f.removedAfter(), now); merr != nil {
+			log.Printf("Error during marking missing items for %s, err=%v", source, merr)
+		}
+	}
+
+	if serr := DbUpdateSourceFetchState(source); serr != nil {
+		log.Printf("Error during saving fetch state for %s, err=%v", source, serr)
+	}
+	return err
+}
+
+func (f Fetcher) fetchFeed(source *Source) error {
 	log.Printf("Updating feed, source=%s", source)
-	response, err := netClient.Get(source.URL)
+	request, err := http.NewRequest(http.MethodGet, source.URL, nil)
+	if err != nil {
+		return fmt.Errorf("Error during creating request for %s, err=%v", source, err)
+	}
+	// content read by an older parser is fetched and parsed again
+	if source.ParserVersion != parserVersion {
+		source.ETag, source.LastModified, source.ContentHash = "", "", ""
+	}
+	if source.ETag != "" {
+		request.Header.Set("If-None-Match", source.ETag)
+	}
+	if source.LastModified != "" {
+		request.Header.Set("If-Modified-Since", source.LastModified)
+	}
+
+	release := f.hosts.acquire(request.URL.Host)
+	defer release()
+
+	response, err := netClient.Do(request)
 	if err != nil {
 		return fmt.Errorf("Error during fetching for %s, err=%v", source, err)
 	}
 	defer response.Body.Close()
 
+	if response.StatusCode == http.StatusNotModified {
+		log.Printf("Feed not modified, source=%s", source)
+		return nil
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("Error during fetching for %s, status=%s", source, response.Status)
+	}
+
 	log.Printf("Reading fetched rss, source=%s", source)
 	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
 		return fmt.Errorf("Error during reading body for %s, err=%v", source, err)
 	}
 
+	// rules are part of the hash so that changing them re-parses the feed
+	hash := sha256.New()
+	hash.Write(body)
+	fmt.Fprintf(hash, "%v", f.rules(source))
+	contentHash := hex.EncodeToString(hash.Sum(nil))
+	if contentHash == source.ContentHash {
+		log.Printf("Feed content unchanged, source=%s", source)
+		source.ETag = response.Header.Get("ETag")
+		source.LastModified = response.Header.Get("Last-Modified")
+		return nil
+	}
+
+	items, hint, err := f.parseFeed(response.Header.Get("Content-Type"), body, source)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Found %d items", len(items))
+	parsedAt := time.Now()
+	var errs []error
+	for _, item := range items {
+		item.LastSeenAt = parsedAt
+		if _, err := DbUpsertSourceItem(item); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		// the validators of the previous content are kept so that the next
+		// fetch reads the feed again
+		return fmt.Errorf("Error during storing %d of %d items for %s, err=%v", len(errs), len(items), source, errs[0])
+	}
+
+	// only remember the validators once the content has been stored
+	source.ETag = response.Header.Get("ETag")
+	source.LastModified = response.Header.Get("Last-Modified")
+	source.ContentHash = contentHash
+	source.ParserVersion = parserVersion
+	source.UpstreamInterval = hint
+	source.ParsedAt = parsedAt
+	return nil
+}
+
+// parseFeed reads the items of an RSS, Atom or JSON Feed document, along with
+// the refresh interval the feed asks for. Items that cannot be parsed are
+// logged and skipped.
+func (f Fetcher) parseFeed(contentType string, body []byte, source *Source) ([]*Item, time.Duration, error) {
+	rewriter, err := feedfmt.NewRewriter(f.rules(source))
+	if err != nil {
+		return nil, 0, fmt.Errorf("Error during loading rules for %s, err=%v", source, err)
+	}
+
+	var items []*Item
+	if feedfmt.IsJSONFeed(contentType, body) {
+		log.Printf("Parsing json feed, source=%s", source)
+		entries, warnings, err := feedfmt.ParseJSONFeed(body)
+		if err != nil {
+			return nil, 0, fmt.Errorf("Error during parsing feed for %s, err=%v", source, err)
+		}
+		for _, warning := range warnings {
+			log.Printf("warning, source=%s, %s\n", source, warning)
+		}
+		for i := range entries {
+			item, err := f.entryItem(&entries[i], source, rewriter)
+			if err != nil {
+				log.Printf("error, source=%s, guid=%s, err=%v\n", source, entries[i].GUID, err)
+				continue
+			}
+			items = append(items, item)
+		}
+		return items, 0, nil
+	}
+
 	log.Printf("Parsing rss, source=%s", source)
 	doc, err := xmlquery.Parse(strings.NewReader(string(body)))
 	if err != nil {
-		return fmt.Errorf("Error during parsing feed for %s, err=%v", source, err)
+		return nil, 0, fmt.Errorf("Error during parsing feed for %s, err=%v", source, err)
 	}
 
 	log.Printf("Acquiring item list, source=%s", source)
-	list, err := xmlquery.QueryAll(doc, "//item")
+	itemPath, parse := "//item", f.parseItem
+	if feedfmt.IsAtom(doc) {
+		itemPath, parse = "//entry", f.parseAtomEntry
+	}
+	list, err := xmlquery.QueryAll(doc, itemPath)
 	if err != nil {
-		return fmt.Errorf("Error during querying feed items for %s, err=%v", source, err)
+		return nil, 0, fmt.Errorf("Error during querying feed items for %s, err=%v", source, err)
 	}
 
-	log.Printf("Found %d items", len(list))
 	for i, it := range list {
 		log.Printf("Parsing #%d item", i)
-		item, err := f.parseItem(it, source)
+		item, err := parse(it, source, rewriter)
 		if err != nil {
-			log.Printf("error, source=%s, it=%s, err=%v\n", source, it, err)
+			log.Printf("error, source=%s, it=%s, err=%v\n", source, it.OutputXML(true), err)
 			continue
 		}
-		DbUpsertSourceItem(item)
+		items = append(items, item)
 	}
-	return nil
+	return items, upstreamInterval(doc), nil
 }
 
-func (f Fetcher) parseItem(it *xmlquery.Node, source *Source) (*Item, error) {
+func (f Fetcher) parseItem(it *xmlquery.Node, source *Source, rewriter *feedfmt.Rewriter) (*Item, error) {
 	guidNode := it.SelectElement("guid")
 	if guidNode == nil {
 		return nil, fmt.Errorf("cannot parse guid")
@@ -91,64 +319,84 @@ func (f Fetcher) parseItem(it *xmlquery.Node, source *Source) (*Item, error) {
 
 	guid := guidNode.InnerText()
 
+	// items without a usable date get their first seen time when stored
+	var pubDateTime time.Time
+	var warning string
 	pubdateNode := it.SelectElement("pubDate")
 	if pubdateNode == nil {
-		return nil, fmt.Errorf("cannot find pubDate")
+		warning = "missing pubDate, using first seen time"
+	} else if t, err := feedfmt.ParseDate(pubdateNode.InnerText()); err != nil {
+		warning = fmt.Sprintf("%v, using first seen time", err)
+	} else {
+		pubDateTime = t
+	}
+
+	raw := it.OutputXML(true)
+
+	if !pubDateTime.IsZero() {
+		// write the date back in the format podcast apps expect
+		feedfmt.SetText(pubdateNode, pubDateTime.Format(time.RFC1123Z))
 	}
 
-	pubDate := pubdateNode.InnerText()
-	pubDateTime, err := time.Parse(time.RFC1123, pubDate)
+	err := rewriter.Apply(it, *source)
 	if err != nil {
-		pubDateTime, err = time.Parse(time.RFC1123Z, pubDate)
-		if err != nil {
-			// assign default pubdate
-			pubDateTime = time.Date(2001, time.January, 13, 18, 12, 23, 0, defaultLocation)
-		}
+		return nil, err
 	}
 
-	var title string
-	if n := it.SelectElement("title"); n != nil {
-		title = n.InnerText()
+	item := Item{
+		FeedID:  source.ID,
+		GUID:    guid,
+		PubDate: pubDateTime,
+		Raw:     raw,
+		Entry:   feedfmt.OutputXML(it),
+		Warning: warning,
 	}
-	var description string
-	if n := it.SelectElement("description"); n != nil {
-		description = n.InnerText()
+	// read the fields after rewriting so they match the served entry
+	item.SetEntryFields(feedfmt.ReadItem(it))
+	return &item, nil
+}
+
+func (f Fetcher) parseAtomEntry(it *xmlquery.Node, source *Source, rewriter *feedfmt.Rewriter) (*Item, error) {
+	entry, err := feedfmt.ParseAtomEntry(it)
+	if err != nil {
+		return nil, err
 	}
+	return f.entryItem(entry, source, rewriter)
+}
 
-	var enclosureUrl string
-	if n := it.SelectElement("enclosure"); n != nil {
-		for _, attr := range n.Attr {
-			if attr.Name.Local == "url" {
-				enclosureUrl = attr.Value
-				fmt.Printf("enclosure URL: %s\n", enclosureUrl)
-			}
-		}
+// entryItem maps an entry read from an Atom or JSON feed to an item whose
+// Entry is an equivalent RSS item, so it can be rendered alongside items of
+// RSS sources.
+func (f Fetcher) entryItem(entry *feedfmt.Entry, source *Source, rewriter *feedfmt.Rewriter) (*Item, error) {
+	var warning string
+	if entry.PubDate.IsZero() {
+		warning = fmt.Sprintf("cannot parse date %q, using first seen time", entry.RawPubDate)
 	}
-	raw := it.OutputXML(true)
 
-	// remove blacklist node
-	if n := it.SelectElement("itunes:season"); n != nil {
-		prev := n.PrevSibling
-		next := n.NextSibling
-		if prev != nil {
-			prev.NextSibling = next
-		}
+	rss, err := rewriter.ApplyString(entry.RSS(), *source)
+	if err != nil {
+		return nil, err
+	}
 
-		if next != nil {
-			next.PrevSibling = prev
-		}
+	node, err := feedfmt.ParseItem(rss)
+	if err != nil {
+		return nil, err
 	}
 
-	entry := it.OutputXML(true)
 	item := Item{
-		GUID:         guid,
-		FeedID:       source.ID,
-		PubDate:      pubDateTime,
-		Title:        title,
-		Description:  description,
-		Raw:          raw,
-		Entry:        entry,
-		EnclosureUrl: enclosureUrl,
+		FeedID:  source.ID,
+		GUID:    entry.GUID,
+		PubDate: entry.PubDate,
+		Raw:     entry.Raw,
+		Entry:   rss,
+		Warning: warning,
 	}
+	item.SetEntryFields(feedfmt.ReadItem(node))
 	return &item, nil
 }
+
+// rules returns the rewrite rules applied to the items of source when they
+// are fetched. Channel rules are applied when a channel is served.
+func (f Fetcher) rules(source *Source) []feedfmt.Rule {
+	return f.Config.Sources[source.Slug].Rules
+}
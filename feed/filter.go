@@ -0,0 +1,364 @@
+package feed
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/antchfx/xmlquery"
+
+	"github.com/wiennat/rjio/pkg/feedfmt"
+)
+
+// Filter actions.
+const (
+	FilterExclude = "exclude"
+	FilterInclude = "include"
+)
+
+// FilterRule selects items by their properties. An item matches a rule when
+// it matches every condition set on the rule. Items matching an exclude rule
+// are left out of the feed; when include rules exist, items must match one of
+// them to be kept.
+type FilterRule struct {
+	Name   string `yaml:"name,omitempty"`
+	Action string `yaml:"action,omitempty"`
+
+	// Title, Description and Category are regular expressions, Category is
+	// matched against every category and itunes:category of the item
+	Title       string `yaml:"title,omitempty"`
+	Description string `yaml:"description,omitempty"`
+	Category    string `yaml:"category,omitempty"`
+	// EpisodeType is compared with itunes:episodeType, e.g. full or trailer
+	EpisodeType string `yaml:"episode-type,omitempty"`
+	// MinDuration and MaxDuration bound itunes:duration, items without a
+	// duration never match them
+	MinDuration time.Duration `yaml:"min-duration,omitempty"`
+	MaxDuration time.Duration `yaml:"max-duration,omitempty"`
+	// PublishedAfter and PublishedBefore bound the publication date
+	PublishedAfter  string `yaml:"published-after,omitempty"`
+	PublishedBefore string `yaml:"published-before,omitempty"`
+}
+
+// FilteredItem is an item left out of a channel along with the reason.
+type FilteredItem struct {
+	Item
+	Rule string
+}
+
+type compiledFilter struct {
+	FilterRule
+	title       *regexp.Regexp
+	description *regexp.Regexp
+	category    *regexp.Regexp
+	after       time.Time
+	before      time.Time
+}
+
+// compiledFilters holds the filters of the configuration, compiled once when
+// it is loaded, and those of channels stored in the database, compiled when
+// first used.
+type compiledFilters struct {
+	mu sync.Mutex
+	// channel are the filters of the default channel
+	channel []compiledFilter
+	// options are keyed by channel slug, sources by source slug
+	options map[string][]compiledFilter
+	sources map[string][]compiledFilter
+	// channels are keyed by channel id
+	channels map[int64][]compiledFilter
+}
+
+var filterCache = &compiledFilters{}
+
+// itemFacts are the item properties filters look at.
+type itemFacts struct {
+	Title       string
+	Description string
+	EpisodeType string
+	Duration    time.Duration
+	Categories  []string
+	PubDate     time.Time
+}
+
+func compileFilters(rules []FilterRule, scope string) ([]compiledFilter, error) {
+	var filters []compiledFilter
+	for i, rule := range rules {
+		filter := compiledFilter{FilterRule: rule}
+		if filter.Name == "" {
+			filter.Name = fmt.Sprintf("%s #%d", scope, i+1)
+		}
+
+		switch rule.Action {
+		case "":
+			filter.Action = FilterExclude
+		case FilterExclude, FilterInclude:
+		default:
+			return nil, fmt.Errorf("%s: unknown action %s", filter.Name, rule.Action)
+		}
+
+		var err error
+		if filter.title, err = compileOptional(rule.Title); err != nil {
+			return nil, fmt.Errorf("%s: %v", filter.Name, err)
+		}
+		if filter.description, err = compileOptional(rule.Description); err != nil {
+			return nil, fmt.Errorf("%s: %v", filter.Name, err)
+		}
+		if filter.category, err = compileOptional(rule.Category); err != nil {
+			return nil, fmt.Errorf("%s: %v", filter.Name, err)
+		}
+		if rule.PublishedAfter != "" {
+			if filter.after, err = feedfmt.ParseDate(rule.PublishedAfter); err != nil {
+				return nil, fmt.Errorf("%s: %v", filter.Name, err)
+			}
+		}
+		if rule.PublishedBefore != "" {
+			if filter.before, err = feedfmt.ParseDate(rule.PublishedBefore); err != nil {
+				return nil, fmt.Errorf("%s: %v", filter.Name, err)
+			}
+		}
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+func compileOptional(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile(pattern)
+}
+
+// readsEntry reports whether the filter looks at properties only found in
+// the stored entry.
+func (f compiledFilter) readsEntry(item *Item) bool {
+	return f.EpisodeType != "" || f.category != nil ||
+		((f.MinDuration > 0 || f.MaxDuration > 0) && item.Duration == 0)
+}
+
+func (f compiledFilter) match(facts *itemFacts) bool {
+	if f.title != nil && !f.title.MatchString(facts.Title) {
+		return false
+	}
+	if f.description != nil && !f.description.MatchString(facts.Description) {
+		return false
+	}
+	if f.EpisodeType != "" && !strings.EqualFold(f.EpisodeType, facts.EpisodeType) {
+		return false
+	}
+	if f.MinDuration > 0 && (facts.Duration == 0 || facts.Duration < f.MinDuration) {
+		return false
+	}
+	if f.MaxDuration > 0 && (facts.Duration == 0 || facts.Duration > f.MaxDuration) {
+		return false
+	}
+	if !f.after.IsZero() && !facts.PubDate.After(f.after) {
+		return false
+	}
+	if !f.before.IsZero() && !facts.PubDate.Before(f.before) {
+		return false
+	}
+	if f.category != nil {
+		matched := false
+		for _, category := range facts.Categories {
+			if f.category.MatchString(category) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// factsOf reads the properties filters need, parsing the stored entry only
+// when some filter looks at properties that are not columns.
+func factsOf(item *Item, filters []compiledFilter) *itemFacts {
+	facts := &itemFacts{
+		Title:       item.Title,
+		Description: item.Description,
+		Duration:    item.Duration,
+		PubDate:     item.PubDate,
+	}
+
+	readsEntry := false
+	for _, filter := range filters {
+		readsEntry = readsEntry || filter.readsEntry(item)
+	}
+	if !readsEntry {
+		return facts
+	}
+
+	node, err := feedfmt.ParseItem(item.Entry)
+	if err != nil {
+		return facts
+	}
+	if n := node.SelectElement("itunes:episodeType"); n != nil {
+		facts.EpisodeType = strings.TrimSpace(n.InnerText())
+	}
+	if n := node.SelectElement("itunes:duration"); n != nil && facts.Duration == 0 {
+		facts.Duration, _ = feedfmt.ParseDuration(n.InnerText())
+	}
+	for _, n := range node.SelectElements("category") {
+		facts.Categories = append(facts.Categories, strings.TrimSpace(n.InnerText()))
+	}
+	for _, n := range xmlquery.Find(node, ".//itunes:category") {
+		facts.Categories = append(facts.Categories, n.SelectAttr("text"))
+	}
+	return facts
+}
+
+// filterItems splits items into those kept in a channel and those left out
+// by the channel filters or the filters of their source, or because they were
+// removed upstream.
+func filterItems(items []Item, channelFilters []compiledFilter, sourceFilters map[int64][]compiledFilter) ([]Item, []FilteredItem) {
+	kept := make([]Item, 0, len(items))
+	var dropped []FilteredItem
+	for _, item := range items {
+		if !item.RemovedAt.IsZero() && !cfg.Fetcher.ServeRemoved {
+			dropped = append(dropped, FilteredItem{Item: item, Rule: "removed upstream"})
+			continue
+		}
+
+		filters := append(channelFilters[:len(channelFilters):len(channelFilters)], sourceFilters[item.FeedID]...)
+		if len(filters) == 0 {
+			kept = append(kept, item)
+			continue
+		}
+
+		if rule, ok := excludedBy(filters, factsOf(&item, filters)); ok {
+			dropped = append(dropped, FilteredItem{Item: item, Rule: rule})
+			continue
+		}
+		kept = append(kept, item)
+	}
+	return kept, dropped
+}
+
+func excludedBy(filters []compiledFilter, facts *itemFacts) (string, bool) {
+	hasInclude, included := false, false
+	for _, filter := range filters {
+		switch filter.Action {
+		case FilterExclude:
+			if filter.match(facts) {
+				return filter.Name, true
+			}
+		case FilterInclude:
+			hasInclude = true
+			included = included || filter.match(facts)
+		}
+	}
+	if hasInclude && !included {
+		return "no include rule matched", true
+	}
+	return "", false
+}
+
+// loadFilters compiles every configured filter, failing on the first one
+// that is invalid.
+func loadFilters(config *Config) error {
+	cache := &compiledFilters{
+		options:  make(map[string][]compiledFilter),
+		sources:  make(map[string][]compiledFilter),
+		channels: make(map[int64][]compiledFilter),
+	}
+	var err error
+	if cache.channel, err = compileFilters(config.Channel.Filters, "channel"); err != nil {
+		return err
+	}
+	for slug, channel := range config.Channels {
+		if cache.options[slug], err = compileFilters(channel.Filters, "channel "+slug); err != nil {
+			return err
+		}
+	}
+	for slug, source := range config.Sources {
+		if cache.sources[slug], err = compileFilters(source.Filters, "source "+slug); err != nil {
+			return err
+		}
+	}
+	filterCache = cache
+	return nil
+}
+
+// channelFilters returns the compiled filters of a channel, those stored with
+// it followed by those configured for its slug. The default channel has a
+// zero id.
+func channelFilters(channel *Channel) ([]compiledFilter, error) {
+	if channel.ID == 0 {
+		return filterCache.channel, nil
+	}
+
+	filterCache.mu.Lock()
+	defer filterCache.mu.Unlock()
+	if filters, ok := filterCache.channels[channel.ID]; ok {
+		return filters, nil
+	}
+	filters, err := compileFilters(channel.Filters, "channel "+channel.Slug)
+	if err != nil {
+		return nil, err
+	}
+	filters = append(filters, filterCache.options[channel.Slug]...)
+	if filterCache.channels == nil {
+		filterCache.channels = make(map[int64][]compiledFilter)
+	}
+	filterCache.channels[channel.ID] = filters
+	return filters, nil
+}
+
+// forgetChannelFilters drops the compiled filters of a channel once it is
+// changed or deleted.
+func forgetChannelFilters(id int64) {
+	filterCache.mu.Lock()
+	defer filterCache.mu.Unlock()
+	delete(filterCache.channels, id)
+}
+
+// defaultChannel is the channel made of the configured settings.
+func defaultChannel() Channel {
+	return Channel{ChannelConfig: cfg.Channel}
+}
+
+// selectChannelItems applies the edits made to items, the filters of the
+// channel and of the sources of items, then leaves out copies of items from
+// other sources and items not yet published, returning the items to serve,
+// pinned ones first, and those left out. Items published for the first time
+// are recorded when record is set, pages only showing the channel leave it
+// unset.
+func selectChannelItems(channel Channel, items []Item, record bool) ([]Item, []FilteredItem, error) {
+	overrides, err := itemOverrides()
+	if err != nil {
+		return nil, nil, err
+	}
+	items, hidden := applyOverrides(items, overrides)
+
+	filters, err := channelFilters(&channel)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sourceFilters := make(map[int64][]compiledFilter)
+	if len(filterCache.sources) > 0 {
+		for _, source := range DbListSource() {
+			if compiled := filterCache.sources[source.Slug]; len(compiled) > 0 {
+				sourceFilters[source.ID] = compiled
+			}
+		}
+	}
+
+	kept, dropped := filterItems(items, filters, sourceFilters)
+	dropped = append(hidden, dropped...)
+	kept, duplicates := dedupItems(kept)
+	for _, d := range duplicates {
+		dropped = append(dropped, FilteredItem{Item: d.Item, Rule: duplicateRule(d)})
+	}
+	kept, scheduled, err := publishChannelItems(channel.Slug, kept, time.Now(), record)
+	if err != nil {
+		return nil, nil, err
+	}
+	dropped = append(dropped, scheduled...)
+	return pinFirst(kept, overrides), dropped, nil
+}
@@ -0,0 +1,34 @@
+package feed
+
+import "sync"
+
+// hostLimiter bounds the number of concurrent requests sent to a single host.
+type hostLimiter struct {
+	limit int
+	mu    sync.Mutex
+	slots map[string]chan struct{}
+}
+
+func newHostLimiter(limit int) *hostLimiter {
+	return &hostLimiter{
+		limit: limit,
+		slots: make(map[string]chan struct{}),
+	}
+}
+
+// acquire blocks until a slot for host is free and returns the function
+// releasing it.
+func (l *hostLimiter) acquire(host string) func() {
+	l.mu.Lock()
+	slot, ok := l.slots[host]
+	if !ok {
+		slot = make(chan struct{}, l.limit)
+		l.slots[host] = slot
+	}
+	l.mu.Unlock()
+
+	slot <- struct{}{}
+	return func() {
+		<-slot
+	}
+}
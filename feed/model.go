@@ -2,9 +2,10 @@ package feed
 
 import (
 	"fmt"
-	"net/url"
-	"strings"
+	"log"
 	"time"
+
+	"github.com/wiennat/rjio/pkg/feedfmt"
 )
 
 // CustomFeed represents template variables used for rendering RSS feed
@@ -24,6 +25,35 @@ type Source struct {
 	URL  string `xorm:" varchar(200) not null" json:"url"`
 	Slug string `xorm:" varchar(200) not null" json:"slug"`
 	Name string `xorm:" varchar(200) not null" json:"name"`
+
+	// validators from the last successful fetch, used for conditional GET
+	ETag         string `xorm:"'etag' varchar(200) null" json:"-"`
+	LastModified string `xorm:" varchar(200) null" json:"-"`
+	ContentHash  string `xorm:" varchar(64) null" json:"-"`
+	// ParserVersion is the version of the parser the content was read with
+	ParserVersion int `xorm:" not null default 0" json:"-"`
+
+	// FetchInterval overrides the fetcher interval when set
+	FetchInterval    time.Duration `xorm:" null" json:"fetchInterval"`
+	UpstreamInterval time.Duration `xorm:" null" json:"upstreamInterval"`
+	LastFetchedAt    time.Time     `xorm:" null" json:"lastFetchedAt"`
+	NextFetchAt      time.Time     `xorm:" null" json:"nextFetchAt"`
+	FailureCount     int           `xorm:" null" json:"failureCount"`
+	LastError        string        `xorm:" text null" json:"lastError"`
+	// ParsedAt is when the feed was last read, items not seen since are
+	// missing upstream
+	ParsedAt time.Time `xorm:" null" json:"parsedAt"`
+
+	// disabled sources are not fetched, nor are paused ones until
+	// PausedUntil. HideItems also leaves the items of a disabled source out of
+	// the feeds.
+	Enabled     bool      `xorm:" not null default 1" json:"enabled"`
+	PausedUntil time.Time `xorm:" null" json:"pausedUntil"`
+	HideItems   bool      `xorm:" not null default 0" json:"hideItems"`
+}
+
+func (s Source) String() string {
+	return fmt.Sprintf("%d:%s", s.ID, s.Slug)
 }
 
 // Item represents an item in a feed
@@ -37,6 +67,106 @@ type Item struct {
 	Raw          string    `json:"raw"`
 	EnclosureUrl string    `xorm:" varchar(200) null" json:"enclosureUrl"`
 	Entry        string    `json:"entry"`
+	// Link, Author, enclosure and duration are read from Entry and used to
+	// render the feed in formats other than RSS
+	Link            string        `xorm:" text null" json:"link,omitempty"`
+	Author          string        `xorm:" varchar(200) null" json:"author,omitempty"`
+	EnclosureType   string        `xorm:" varchar(100) null" json:"enclosureType,omitempty"`
+	EnclosureLength int64         `xorm:" null" json:"enclosureLength,omitempty"`
+	Duration        time.Duration `xorm:" null" json:"duration,omitempty"`
+	FirstSeenAt     time.Time     `xorm:" null" json:"firstSeenAt"`
+	LastSeenAt      time.Time     `xorm:" null index" json:"lastSeenAt"`
+	// MissingCount counts the successful fetches in a row the item was
+	// missing from, RemovedAt is set once it is considered removed upstream
+	MissingCount int       `xorm:" not null default 0" json:"missingCount"`
+	RemovedAt    time.Time `xorm:" null" json:"removedAt"`
+	// Restored items are served although removed upstream
+	Restored bool `xorm:" not null default 0" json:"restored"`
+	// Warning describes problems met while parsing the item
+	Warning string `xorm:" text null" json:"warning,omitempty"`
+}
+
+// Channel is a named output feed made of the items of its member sources.
+type Channel struct {
+	ID            int64  `json:"id"`
+	Slug          string `xorm:" varchar(200) not null unique" json:"slug"`
+	ChannelConfig `xorm:"extends" json:"config"`
+	// AllSources includes every source, current and future
+	AllSources bool `json:"allSources"`
+}
+
+// ChannelSource links a channel to one of its member sources.
+type ChannelSource struct {
+	ID        int64 `json:"id"`
+	ChannelID int64 `xorm:" not null index" json:"channelId"`
+	SourceID  int64 `xorm:" not null index" json:"sourceId"`
+}
+
+// Hit is a download of an enclosure through the built-in tracker.
+type Hit struct {
+	ID        int64     `json:"id"`
+	ItemID    int64     `xorm:" not null index" json:"itemId"`
+	SourceID  int64     `xorm:" not null index" json:"sourceId"`
+	CreatedAt time.Time `xorm:" not null index" json:"createdAt"`
+	// IPHash is a keyed hash of the client address, the address itself is
+	// not stored
+	IPHash    string `xorm:" varchar(64) not null" json:"ipHash"`
+	UserAgent string `xorm:" text null" json:"userAgent"`
+	Range     string `xorm:" varchar(200) null" json:"range"`
+	Referer   string `xorm:" text null" json:"referer"`
+}
+
+// PrunedItem records an item deleted by the retention policy, so that it is
+// not stored again with a new id while its source still lists it.
+type PrunedItem struct {
+	ID       int64     `json:"-"`
+	FeedID   int64     `xorm:" not null index" json:"feedId"`
+	GUID     string    `xorm:" varchar(200) not null" json:"guid"`
+	PrunedAt time.Time `xorm:" not null" json:"prunedAt"`
+}
+
+// ItemOverride holds the changes editors make to an item. It is stored apart
+// from the fetched item so that fetches do not undo it.
+type ItemOverride struct {
+	ID     int64 `json:"-"`
+	ItemID int64 `xorm:" not null unique" json:"itemId"`
+	Hidden bool  `xorm:" not null default 0" json:"hidden"`
+	// Pinned items come first in the feeds
+	Pinned bool `xorm:" not null default 0" json:"pinned"`
+	// Title and Description replace those of the item when not empty
+	Title       string    `xorm:" text null" json:"title"`
+	Description string    `xorm:" text null" json:"description"`
+	UpdatedAt   time.Time `xorm:" null" json:"updatedAt"`
+}
+
+// ItemPublication is when an item was published in a channel held back by a
+// publish delay or limit. The default channel has an empty slug.
+type ItemPublication struct {
+	ID          int64     `json:"-"`
+	Channel     string    `xorm:" varchar(200) not null unique(channel_item)" json:"channel"`
+	ItemID      int64     `xorm:" not null unique(channel_item) index" json:"itemId"`
+	PublishedAt time.Time `xorm:" not null" json:"publishedAt"`
+}
+
+// PublishSetting records since when a publish delay or limit is in effect.
+type PublishSetting struct {
+	ID    int64     `json:"-"`
+	Name  string    `xorm:" varchar(200) not null unique" json:"name"`
+	Since time.Time `xorm:" not null" json:"since"`
+}
+
+// ApiToken lets scripts use the API without signing in. Only a hash of the
+// token is stored, it is shown once when created.
+type ApiToken struct {
+	ID        int64  `json:"id"`
+	Name      string `xorm:" varchar(200) not null" json:"name"`
+	TokenHash string `xorm:" varchar(64) not null unique" json:"-"`
+	// Prefix is the start of the token, to tell tokens apart in the UI
+	Prefix string `xorm:" varchar(20) not null" json:"prefix"`
+	// Scopes is a comma separated list of scopes
+	Scopes     string    `xorm:" varchar(200) not null" json:"scopes"`
+	CreatedAt  time.Time `xorm:" not null" json:"createdAt"`
+	LastUsedAt time.Time `xorm:" null" json:"lastUsedAt"`
 }
 
 var storage *SqlStorage
@@ -61,6 +191,14 @@ func DbUpdateSource(source *Source) error {
 	return storage.UpdateSource(source)
 }
 
+func DbUpdateSourceFetchState(source *Source) error {
+	return storage.UpdateSourceFetchState(source)
+}
+
+func DbUpdateSourceState(source *Source) error {
+	return storage.UpdateSourceState(source)
+}
+
 func DbDeleteSource(id int64) error {
 	return storage.DeleteSource(id)
 }
@@ -81,6 +219,10 @@ func DbGetSourceItems(sourceID int64, offset int, limit int) ([]Item, error) {
 	return storage.GetSourceItems(sourceID, offset, limit)
 }
 
+func DbListSourceItems(sourceID int64, since time.Time, offset int, limit int) ([]Item, error) {
+	return storage.ListSourceItems(sourceID, since, offset, limit)
+}
+
 func DbUpsertSourceItem(item *Item) (int64, error) {
 	return storage.UpsertSourceItem(item)
 }
@@ -89,41 +231,212 @@ func DbDeleteItemsBySource(sourceID int64) (int64, error) {
 	return storage.DeleteItemsBySource(sourceID)
 }
 
+func DbDeleteItemsPublishedBefore(sourceID int64, before time.Time) (int64, error) {
+	return storage.DeleteItemsPublishedBefore(sourceID, before)
+}
+
+func DbDeleteItemsRemovedBefore(sourceID int64, before time.Time) (int64, error) {
+	return storage.DeleteItemsRemovedBefore(sourceID, before)
+}
+
+func DbMarkMissingItems(sourceID int64, parsedAt time.Time, removedAfter int, now time.Time) error {
+	return storage.MarkMissingItems(sourceID, parsedAt, removedAfter, now)
+}
+
+func DbListRemovedItems(sourceID int64) ([]Item, error) {
+	return storage.ListRemovedItems(sourceID)
+}
+
+func DbRestoreItem(id int64) error {
+	return storage.RestoreItem(id)
+}
+
+func DbDeleteItemsBeyond(sourceID int64, keep int) (int64, error) {
+	return storage.DeleteItemsBeyond(sourceID, keep)
+}
+
 func DbGetItemsForCustomFeed(offset int, limit int) ([]Item, error) {
 	return storage.GetItemsForCustomFeed(offset, limit)
 }
 
-// apply prefix to enclosure url
-func ApplyEnclosurePrefix(items []Item, prefix string) ([]Item, error) {
-	// find enclosure url in Entry and replace with prefix one
+func DbGetItemsForChannel(channel *Channel, offset int, limit int) ([]Item, error) {
+	return storage.GetItemsForChannel(channel, offset, limit)
+}
+
+func DbListChannel() ([]Channel, error) {
+	return storage.ListChannel()
+}
+
+func DbGetChannel(id int64) (Channel, error) {
+	return storage.GetChannel(id)
+}
+
+func DbGetChannelBySlug(slug string) (Channel, error) {
+	return storage.GetChannelBySlug(slug)
+}
+
+func DbCreateChannel(channel *Channel) error {
+	return storage.CreateChannel(channel)
+}
+
+func DbUpdateChannel(channel *Channel) error {
+	return storage.UpdateChannel(channel)
+}
+
+func DbDeleteChannel(id int64) error {
+	return storage.DeleteChannel(id)
+}
 
-	if prefix == "" {
-		return items, nil
+func DbGetChannelSourceIDs(channelID int64) ([]int64, error) {
+	return storage.GetChannelSourceIDs(channelID)
+}
+
+func DbGetItem(id int64) (Item, error) {
+	return storage.GetItem(id)
+}
+
+func DbCreateHit(hit *Hit) error {
+	return storage.CreateHit(hit)
+}
+
+func DbListHits(from time.Time, to time.Time, sourceID int64) ([]Hit, error) {
+	return storage.ListHits(from, to, sourceID)
+}
+
+func DbGetItems(ids []int64) ([]Item, error) {
+	return storage.GetItems(ids)
+}
+
+func DbGetItemOverride(itemID int64) (ItemOverride, error) {
+	return storage.GetItemOverride(itemID)
+}
+
+func DbListItemOverrides() ([]ItemOverride, error) {
+	return storage.ListItemOverrides()
+}
+
+func DbListItemPublications(channel string) ([]ItemPublication, error) {
+	return storage.ListItemPublications(channel)
+}
+
+func DbSaveItemPublication(publication *ItemPublication) error {
+	return storage.SaveItemPublication(publication)
+}
+
+func DbListPublishSettings() ([]PublishSetting, error) {
+	return storage.ListPublishSettings()
+}
+
+func DbCreatePublishSetting(setting *PublishSetting) error {
+	return storage.CreatePublishSetting(setting)
+}
+
+func DbDeletePublishSetting(id int64) error {
+	return storage.DeletePublishSetting(id)
+}
+
+func DbSaveItemOverride(override *ItemOverride) error {
+	return storage.SaveItemOverride(override)
+}
+
+func DbDeleteItemOverride(itemID int64) error {
+	return storage.DeleteItemOverride(itemID)
+}
+
+func DbListApiTokens() ([]ApiToken, error) {
+	return storage.ListApiTokens()
+}
+
+func DbGetApiTokenByHash(hash string) (ApiToken, error) {
+	return storage.GetApiTokenByHash(hash)
+}
+
+func DbCreateApiToken(token *ApiToken) error {
+	return storage.CreateApiToken(token)
+}
+
+func DbDeleteApiToken(id int64) error {
+	return storage.DeleteApiToken(id)
+}
+
+func DbTouchApiToken(id int64, usedAt time.Time) error {
+	return storage.TouchApiToken(id, usedAt)
+}
+
+func DbSetChannelSources(channelID int64, sourceIDs []int64) error {
+	return storage.SetChannelSources(channelID, sourceIDs)
+}
+
+// feedItem returns the fields of item shared with the command line tool.
+func (item *Item) feedItem() feedfmt.Item {
+	return feedfmt.Item{
+		GUID:            item.GUID,
+		Title:           item.Title,
+		Description:     item.Description,
+		PubDate:         item.PubDate,
+		Raw:             item.Raw,
+		EnclosureUrl:    item.EnclosureUrl,
+		Entry:           item.Entry,
+		Link:            item.Link,
+		Author:          item.Author,
+		EnclosureType:   item.EnclosureType,
+		EnclosureLength: item.EnclosureLength,
+		Duration:        item.Duration,
 	}
+}
 
-	for i, item := range items {
-		if strings.Contains(item.EnclosureUrl, "https://anchor.fm/") {
-			// handle anchor.fm url
-			enclosureURLAttr := fmt.Sprintf("url=\"%s\"", item.EnclosureUrl)
-			colonPosition := strings.Index(item.EnclosureUrl, "://")
-			protocol := item.EnclosureUrl[0:colonPosition]
-			escapedURL := item.EnclosureUrl[(colonPosition + 3):]
-			unescaped, err := url.PathUnescape(escapedURL)
-			if err != nil {
-				return nil, err
-			}
-			newEnclosureURLAttr := fmt.Sprintf("url=\"%s://%s%s\"", protocol, prefix, unescaped)
-			items[i].Entry = strings.Replace(item.Entry, enclosureURLAttr, newEnclosureURLAttr, 1)
-		} else {
-
-			enclosureURLAttr := fmt.Sprintf("url=\"%s\"", item.EnclosureUrl)
-			colonPosition := strings.Index(item.EnclosureUrl, "://")
-			protocol := item.EnclosureUrl[0:colonPosition]
-			url := item.EnclosureUrl[(colonPosition + 3):]
-			newEnclosureURLAttr := fmt.Sprintf("url=\"%s://%s%s\"", protocol, prefix, url)
-			items[i].Entry = strings.Replace(item.Entry, enclosureURLAttr, newEnclosureURLAttr, 1)
-		}
+// setFeedItem copies the fields shared with the command line tool into item.
+func (item *Item) setFeedItem(shared feedfmt.Item) {
+	item.GUID = shared.GUID
+	item.Title = shared.Title
+	item.Description = shared.Description
+	item.PubDate = shared.PubDate
+	item.Raw = shared.Raw
+	item.EnclosureUrl = shared.EnclosureUrl
+	item.Entry = shared.Entry
+	item.Link = shared.Link
+	item.Author = shared.Author
+	item.EnclosureType = shared.EnclosureType
+	item.EnclosureLength = shared.EnclosureLength
+	item.Duration = shared.Duration
+}
+
+// SetEntryFields copies the fields read from the rendered entry of an item.
+func (item *Item) SetEntryFields(entry feedfmt.Entry) {
+	shared := item.feedItem()
+	shared.SetEntryFields(entry)
+	item.setFeedItem(shared)
+}
+
+// FeedEntry returns the item as an entry for rendering the Atom and JSON
+// feeds.
+func (item Item) FeedEntry() feedfmt.Entry {
+	return item.feedItem().FeedEntry()
+}
+
+// RewriteEnclosures rewrites the enclosures of the entry of item and its
+// enclosure URL. The item is left as it is when its entry cannot be
+// rewritten.
+func (item *Item) RewriteEnclosures(rewriter feedfmt.EnclosureRewriter) error {
+	shared := item.feedItem()
+	if err := shared.RewriteEnclosures(rewriter); err != nil {
+		return err
 	}
+	item.setFeedItem(shared)
+	return nil
+}
 
-	return items, nil
+// ApplyEnclosureRewriter rewrites the enclosures of items, leaving them as
+// they are when rewriter is nil. Items that cannot be rewritten are logged
+// and served with their original enclosures.
+func ApplyEnclosureRewriter(items []Item, rewriter feedfmt.EnclosureRewriter) []Item {
+	if rewriter == nil {
+		return items
+	}
+	for i := range items {
+		if err := items[i].RewriteEnclosures(rewriter); err != nil {
+			log.Printf("Serving item with its original enclosure, err=%v", err)
+		}
+	}
+	return items
 }
@@ -0,0 +1,329 @@
+package feed
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+// openAPIDocument describes every route of ApiRouter, keep it in sync when
+// changing the API.
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// maxRequestBody limits the size of the API request bodies.
+const maxRequestBody = 1 << 20
+
+// apiSpec is the part of the OpenAPI document used to validate requests.
+type apiSpec struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]*schema `json:"schemas"`
+	} `json:"components"`
+}
+
+type apiOperation struct {
+	RequestBody *struct {
+		Required bool `json:"required"`
+		Content  map[string]struct {
+			Schema *schema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+}
+
+// schema is the subset of JSON Schema used by the OpenAPI document.
+type schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 string             `json:"type"`
+	Format               string             `json:"format"`
+	Properties           map[string]*schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties *bool              `json:"additionalProperties"`
+	Items                *schema            `json:"items"`
+	MinLength            *int               `json:"minLength"`
+	Pattern              string             `json:"pattern"`
+	Enum                 []interface{}      `json:"enum"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+
+	// pattern is Pattern compiled by resolveSchema
+	pattern *regexp.Regexp
+}
+
+// requestSchemas maps "METHOD /path" to the schema of the request body.
+var requestSchemas map[string]*schema
+
+func init() {
+	var err error
+	requestSchemas, err = loadRequestSchemas(openAPIDocument)
+	if err != nil {
+		log.Fatalf("invalid openapi document: %v", err)
+	}
+}
+
+func loadRequestSchemas(document []byte) (map[string]*schema, error) {
+	var spec apiSpec
+	err := json.Unmarshal(document, &spec)
+	if err != nil {
+		return nil, err
+	}
+
+	schemas := make(map[string]*schema)
+	for path, item := range spec.Paths {
+		for method, raw := range item {
+			if method == "parameters" {
+				continue
+			}
+			var op apiOperation
+			err := json.Unmarshal(raw, &op)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %v", method, path, err)
+			}
+			if op.RequestBody == nil {
+				continue
+			}
+			// only json bodies are validated
+			content, ok := op.RequestBody.Content["application/json"]
+			if !ok {
+				continue
+			}
+			if content.Schema == nil {
+				return nil, fmt.Errorf("%s %s: request body without a json schema", method, path)
+			}
+			s, err := resolveSchema(content.Schema, spec.Components.Schemas)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %v", method, path, err)
+			}
+			schemas[strings.ToUpper(method)+" "+path] = s
+		}
+	}
+	return schemas, nil
+}
+
+// resolveSchema replaces the references to component schemas in s.
+func resolveSchema(s *schema, components map[string]*schema) (*schema, error) {
+	const prefix = "#/components/schemas/"
+	for s.Ref != "" {
+		if !strings.HasPrefix(s.Ref, prefix) {
+			return nil, fmt.Errorf("unsupported reference %s", s.Ref)
+		}
+		c, ok := components[strings.TrimPrefix(s.Ref, prefix)]
+		if !ok {
+			return nil, fmt.Errorf("unknown schema %s", s.Ref)
+		}
+		s = c
+	}
+
+	for name, p := range s.Properties {
+		resolved, err := resolveSchema(p, components)
+		if err != nil {
+			return nil, err
+		}
+		s.Properties[name] = resolved
+	}
+	if s.Items != nil {
+		resolved, err := resolveSchema(s.Items, components)
+		if err != nil {
+			return nil, err
+		}
+		s.Items = resolved
+	}
+	if s.Pattern != "" && s.pattern == nil {
+		pattern, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		s.pattern = pattern
+	}
+	return s, nil
+}
+
+// matchPath reports whether path matches the templated path of the
+// document, where {name} matches a single segment.
+func matchPath(template string, path string) bool {
+	want := strings.Split(strings.Trim(template, "/"), "/")
+	got := strings.Split(strings.Trim(path, "/"), "/")
+	if len(want) != len(got) {
+		return false
+	}
+	for i := range want {
+		if strings.HasPrefix(want[i], "{") && strings.HasSuffix(want[i], "}") {
+			if got[i] == "" {
+				return false
+			}
+			continue
+		}
+		if want[i] != got[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func requestSchema(method string, path string) *schema {
+	for key, s := range requestSchemas {
+		parts := strings.SplitN(key, " ", 2)
+		if parts[0] == method && matchPath(parts[1], path) {
+			return s
+		}
+	}
+	return nil
+}
+
+// ValidateRequestMiddleware rejects API requests whose body does not match
+// the schema of the OpenAPI document.
+func ValidateRequestMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePath != "" {
+			path = rctx.RoutePath
+		}
+		s := requestSchema(r.Method, path)
+		if s == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if ct := r.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+			render.Render(w, r, ErrInvalidRequest(fmt.Errorf("content type must be application/json")))
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBody))
+		if err != nil {
+			render.Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+
+		var value interface{}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		if err := decoder.Decode(&value); err != nil {
+			render.Render(w, r, ErrInvalidRequest(fmt.Errorf("invalid json, %v", err)))
+			return
+		}
+		if err := validateValue(s, value, "body"); err != nil {
+			render.Render(w, r, ErrInvalidRequest(err))
+			return
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validateValue checks a decoded json value against s, name locates the
+// value in error messages.
+func validateValue(s *schema, value interface{}, name string) error {
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if fmt.Sprint(e) == fmt.Sprint(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s must be one of %v", name, s.Enum)
+		}
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an object", name)
+		}
+		for _, field := range s.Required {
+			if _, ok := obj[field]; !ok {
+				return fmt.Errorf("%s.%s is required", name, field)
+			}
+		}
+		fields := make([]string, 0, len(obj))
+		for field := range obj {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			p, ok := s.Properties[field]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fmt.Errorf("%s.%s is not allowed", name, field)
+				}
+				continue
+			}
+			if err := validateValue(p, obj[field], name+"."+field); err != nil {
+				return err
+			}
+		}
+	case "array":
+		list, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s must be an array", name)
+		}
+		if s.Items != nil {
+			for i, v := range list {
+				if err := validateValue(s.Items, v, fmt.Sprintf("%s[%d]", name, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s must be a string", name)
+		}
+		if s.MinLength != nil && len([]rune(str)) < *s.MinLength {
+			return fmt.Errorf("%s must have at least %d characters", name, *s.MinLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			return fmt.Errorf("%s must match %s", name, s.Pattern)
+		}
+		if s.Format == "uri" {
+			if u, err := url.Parse(str); err != nil || !u.IsAbs() {
+				return fmt.Errorf("%s must be an absolute uri", name)
+			}
+		}
+	case "integer", "number":
+		n, ok := value.(json.Number)
+		if !ok {
+			return fmt.Errorf("%s must be a number", name)
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return fmt.Errorf("%s must be a number", name)
+		}
+		if s.Type == "integer" {
+			if _, err := n.Int64(); err != nil {
+				return fmt.Errorf("%s must be an integer", name)
+			}
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			return fmt.Errorf("%s must be at least %v", name, *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			return fmt.Errorf("%s must be at most %v", name, *s.Maximum)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s must be a boolean", name)
+		}
+	}
+	return nil
+}
+
+func getOpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
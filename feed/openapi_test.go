@@ -0,0 +1,175 @@
+package feed
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const testAPIDocument = `{
+  "paths": {
+    "/things": {
+      "post": {"requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/Thing"}}}}}
+    },
+    "/things/{id}": {
+      "parameters": [{"name": "id", "in": "path"}],
+      "get": {},
+      "put": {"requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/ThingAlias"}}}}}
+    },
+    "/things/{id}/upload": {
+      "post": {"requestBody": {"content": {"application/octet-stream": {}}}}
+    }
+  },
+  "components": {
+    "schemas": {
+      "ThingAlias": {"$ref": "#/components/schemas/Thing"},
+      "Thing": {
+        "type": "object",
+        "required": ["name"],
+        "additionalProperties": false,
+        "properties": {
+          "name": {"type": "string", "minLength": 1, "pattern": "^[a-z]+$"},
+          "url": {"type": "string", "format": "uri"},
+          "kind": {"type": "string", "enum": ["a", "b"]},
+          "count": {"type": "integer", "minimum": 0, "maximum": 10},
+          "ratio": {"type": "number"},
+          "on": {"type": "boolean"},
+          "tags": {"type": "array", "items": {"$ref": "#/components/schemas/Tag"}},
+          "extra": {"type": "object"}
+        }
+      },
+      "Tag": {"type": "string", "minLength": 2}
+    }
+  }
+}`
+
+func decodeTestValue(t *testing.T, body string) interface{} {
+	var value interface{}
+	decoder := json.NewDecoder(strings.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		t.Fatalf("cannot decode %s: %v", body, err)
+	}
+	return value
+}
+
+func TestLoadRequestSchemas(t *testing.T) {
+	schemas, err := loadRequestSchemas([]byte(testAPIDocument))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schemas) != 2 || schemas["POST /things"] == nil || schemas["PUT /things/{id}"] == nil {
+		t.Fatalf("schemas = %v, want POST /things and PUT /things/{id}", schemas)
+	}
+	if schemas["POST /things"] != schemas["PUT /things/{id}"] {
+		t.Errorf("references to Thing resolve to different schemas")
+	}
+	thing := schemas["POST /things"]
+	if thing.Type != "object" || thing.Properties["tags"].Items.Type != "string" {
+		t.Errorf("references in Thing are not resolved: %+v", thing)
+	}
+	if thing.Properties["name"].pattern == nil {
+		t.Errorf("pattern of name is not compiled")
+	}
+
+	if _, err := loadRequestSchemas(openAPIDocument); err != nil {
+		t.Errorf("cannot load the served document: %v", err)
+	}
+}
+
+func TestResolveSchemaErrors(t *testing.T) {
+	components := map[string]*schema{
+		"Loop": {Ref: "#/components/schemas/Other"},
+	}
+	tests := []struct {
+		schema *schema
+		err    string
+	}{
+		{&schema{Ref: "#/components/schemas/Missing"}, "unknown schema #/components/schemas/Missing"},
+		{&schema{Ref: "other.json#/Thing"}, "unsupported reference other.json#/Thing"},
+		{&schema{Ref: "#/components/schemas/Loop"}, "unknown schema #/components/schemas/Other"},
+		{&schema{Type: "object", Properties: map[string]*schema{"a": {Ref: "#/definitions/A"}}}, "unsupported reference #/definitions/A"},
+		{&schema{Type: "array", Items: &schema{Ref: "#/components/schemas/Missing"}}, "unknown schema #/components/schemas/Missing"},
+		{&schema{Type: "string", Pattern: "("}, "error parsing regexp: missing closing ): `(`"},
+	}
+	for _, tt := range tests {
+		_, err := resolveSchema(tt.schema, components)
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("resolveSchema(%+v) = %v, want %s", tt.schema, err, tt.err)
+		}
+	}
+}
+
+func TestValidateValue(t *testing.T) {
+	schemas, err := loadRequestSchemas([]byte(testAPIDocument))
+	if err != nil {
+		t.Fatal(err)
+	}
+	thing := schemas["POST /things"]
+
+	tests := []struct {
+		body string
+		err  string
+	}{
+		{`{"name": "abc"}`, ""},
+		{`{"name": "abc", "url": "https://example.com/feed", "kind": "b", "count": 10, "ratio": 0.5, "on": true, "tags": ["ab", "cd"], "extra": {"any": 1}}`, ""},
+		{`[]`, "body must be an object"},
+		{`{}`, "body.name is required"},
+		{`{"name": "abc", "other": 1}`, "body.other is not allowed"},
+		{`{"name": ""}`, "body.name must have at least 1 characters"},
+		{`{"name": "ABC"}`, "body.name must match ^[a-z]+$"},
+		{`{"name": 1}`, "body.name must be a string"},
+		{`{"name": "abc", "url": "/feed"}`, "body.url must be an absolute uri"},
+		{`{"name": "abc", "url": "http://%zz"}`, "body.url must be an absolute uri"},
+		{`{"name": "abc", "kind": "c"}`, "body.kind must be one of [a b]"},
+		{`{"name": "abc", "count": 1.5}`, "body.count must be an integer"},
+		{`{"name": "abc", "count": 1e1}`, "body.count must be an integer"},
+		{`{"name": "abc", "count": "1"}`, "body.count must be a number"},
+		{`{"name": "abc", "count": -1}`, "body.count must be at least 0"},
+		{`{"name": "abc", "count": 11}`, "body.count must be at most 10"},
+		{`{"name": "abc", "ratio": 1e1}`, ""},
+		{`{"name": "abc", "ratio": true}`, "body.ratio must be a number"},
+		{`{"name": "abc", "on": "yes"}`, "body.on must be a boolean"},
+		{`{"name": "abc", "tags": "ab"}`, "body.tags must be an array"},
+		{`{"name": "abc", "tags": ["ab", "c"]}`, "body.tags[1] must have at least 2 characters"},
+		{`{"name": "abc", "extra": []}`, "body.extra must be an object"},
+		// fields are checked in order
+		{`{"on": 1, "name": "ABC"}`, "body.name must match ^[a-z]+$"},
+	}
+	for _, tt := range tests {
+		err := validateValue(thing, decodeTestValue(t, tt.body), "body")
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.err {
+			t.Errorf("validateValue(%s) = %q, want %q", tt.body, got, tt.err)
+		}
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		template string
+		path     string
+		match    bool
+	}{
+		{"/feeds", "/feeds", true},
+		{"/feeds", "/feeds/", true},
+		{"/feeds", "/feeds/1", false},
+		{"/feeds", "/items", false},
+		{"/feeds/{sourceID}", "/feeds/1", true},
+		{"/feeds/{sourceID}", "/feeds/{sourceID}", true},
+		{"/feeds/{sourceID}", "/feeds", false},
+		{"/feeds/{sourceID}", "/feeds//", false},
+		{"/feeds/{sourceID}/items/{itemID}/override", "/feeds/1/items/2/override", true},
+		{"/feeds/{sourceID}/items/{itemID}/override", "/feeds/1/items/2", false},
+		{"/feeds/{sourceID}/items/{itemID}/override", "/feeds/1/items//override", false},
+		{"/feeds/{sourceID}/refresh", "/feeds/1/items", false},
+	}
+	for _, tt := range tests {
+		if got := matchPath(tt.template, tt.path); got != tt.match {
+			t.Errorf("matchPath(%s, %s) = %v, want %v", tt.template, tt.path, got, tt.match)
+		}
+	}
+}
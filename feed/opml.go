@@ -0,0 +1,159 @@
+package feed
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-chi/render"
+
+	"github.com/wiennat/rjio/pkg/feedfmt"
+)
+
+// ImportEntry is an outline that was not imported and why.
+type ImportEntry struct {
+	Title  string `json:"title"`
+	URL    string `json:"url"`
+	Reason string `json:"reason"`
+}
+
+// ImportResult reports the outcome of an OPML import.
+type ImportResult struct {
+	Created []*FeedSourceResponse `json:"created"`
+	Skipped []ImportEntry         `json:"skipped"`
+	Invalid []ImportEntry         `json:"invalid"`
+	// Error is why the import stopped early, the sources created before are
+	// kept
+	Error string `json:"error,omitempty"`
+}
+
+func (rd *ImportResult) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (rd *ImportResult) String() string {
+	return fmt.Sprintf("imported opml: %d created, %d skipped, %d invalid", len(rd.Created), len(rd.Skipped), len(rd.Invalid))
+}
+
+// importOPML creates a source for each feed of an OPML document. Feeds whose
+// URL is already a source are skipped, slugs are derived from the outline
+// names. The new sources are due right away and left to the fetcher. When
+// creating a source fails, the sources created so far are returned along
+// with the error.
+func importOPML(r io.Reader) (*ImportResult, error) {
+	outlines, err := feedfmt.ReadOPML(r)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ImportResult{Created: []*FeedSourceResponse{}, Skipped: []ImportEntry{}, Invalid: []ImportEntry{}}
+	urls := make(map[string]bool)
+	slugs := make(map[string]bool)
+	for _, source := range DbListSource() {
+		urls[source.URL] = true
+		slugs[source.Slug] = true
+	}
+
+	for _, o := range outlines {
+		entry := ImportEntry{Title: o.Name(), URL: o.XMLURL}
+		u, err := url.Parse(o.XMLURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			entry.Reason = "url must be an http or https URL"
+			result.Invalid = append(result.Invalid, entry)
+			continue
+		}
+		if urls[o.XMLURL] {
+			entry.Reason = "source already exists"
+			result.Skipped = append(result.Skipped, entry)
+			continue
+		}
+
+		base := feedfmt.Slugify(o.Name(), o.XMLURL)
+		slug := base
+		for i := 2; slugs[slug]; i++ {
+			slug = fmt.Sprintf("%s-%d", base, i)
+		}
+		name := o.Name()
+		if name == "" {
+			name = slug
+		}
+
+		source := Source{Slug: slug, Name: name, URL: o.XMLURL, Enabled: true, NextFetchAt: time.Now()}
+		err = DbCreateSource(&source)
+		if err != nil {
+			return result, err
+		}
+		urls[source.URL] = true
+		slugs[source.Slug] = true
+		result.Created = append(result.Created, NewFeedSourceResponse(&source))
+	}
+	return result, nil
+}
+
+func exportOPMLHandler(w http.ResponseWriter, r *http.Request) {
+	var outlines []feedfmt.Outline
+	for _, source := range DbListSource() {
+		outlines = append(outlines, feedfmt.Outline{
+			Text:   source.Name,
+			Title:  source.Name,
+			Type:   "rss",
+			XMLURL: source.URL,
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/x-opml; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="rjio.opml"`)
+	err := feedfmt.WriteOPML(w, cfg.Channel.Title, outlines)
+	if err != nil {
+		log.Printf("cannot write opml, err=%v", err)
+	}
+}
+
+func importOPMLHandler(w http.ResponseWriter, r *http.Request) {
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		w.Write([]byte(fmt.Sprintf("opml file is required")))
+		return
+	}
+	defer file.Close()
+
+	result, err := importOPML(file)
+	if err != nil && result == nil {
+		w.Write([]byte(fmt.Sprintf("cannot import opml, %v", err)))
+		return
+	}
+	if err != nil {
+		w.Write([]byte(fmt.Sprintf("cannot import opml, %v, %s", err, result)))
+		return
+	}
+
+	err = saveFlash(w, r, result.String())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/feeds", http.StatusSeeOther)
+}
+
+// importFeedSourcesHandler imports the OPML document sent as the request
+// body.
+func importFeedSourcesHandler(w http.ResponseWriter, r *http.Request) {
+	result, err := importOPML(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	if err != nil && result == nil {
+		render.Render(w, r, ErrInvalidRequest(fmt.Errorf("invalid opml, %v", err)))
+		return
+	}
+	if err != nil {
+		// the sources created before the error are kept, report them
+		result.Error = err.Error()
+		render.Status(r, http.StatusInternalServerError)
+	}
+
+	if err := render.Render(w, r, result); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
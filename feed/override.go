@@ -0,0 +1,319 @@
+package feed
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+
+	"github.com/wiennat/rjio/pkg/feedfmt"
+)
+
+// empty reports whether the override leaves its item as fetched.
+func (o ItemOverride) empty() bool {
+	return !o.Hidden && !o.Pinned && o.Title == "" && o.Description == ""
+}
+
+// itemOverrides maps item ids to their override.
+func itemOverrides() (map[int64]*ItemOverride, error) {
+	list, err := DbListItemOverrides()
+	if err != nil {
+		return nil, err
+	}
+	overrides := make(map[int64]*ItemOverride, len(list))
+	for i := range list {
+		overrides[list[i].ItemID] = &list[i]
+	}
+	return overrides, nil
+}
+
+// applyOverrides edits the items that have an override, in the entry served
+// in the RSS feed as well as in the fields used by other formats, and leaves
+// out hidden items. Items whose entry cannot be edited are served as
+// fetched.
+func applyOverrides(items []Item, overrides map[int64]*ItemOverride) ([]Item, []FilteredItem) {
+	if len(overrides) == 0 {
+		return items, nil
+	}
+
+	kept := make([]Item, 0, len(items))
+	var hidden []FilteredItem
+	for _, item := range items {
+		o, ok := overrides[item.ID]
+		if !ok {
+			kept = append(kept, item)
+			continue
+		}
+		if o.Hidden {
+			hidden = append(hidden, FilteredItem{Item: item, Rule: "hidden by an editor"})
+			continue
+		}
+		if o.Title != "" || o.Description != "" {
+			entry, err := overrideEntry(item.Entry, o)
+			if err != nil {
+				log.Printf("cannot apply override of item %d, err=%v", item.ID, err)
+				kept = append(kept, item)
+				continue
+			}
+			item.Entry = entry
+			if o.Title != "" {
+				item.Title = o.Title
+			}
+			if o.Description != "" {
+				item.Description = o.Description
+			}
+		}
+		kept = append(kept, item)
+	}
+	return kept, hidden
+}
+
+// overrideEntry rewrites the title and description of an entry, along with
+// their iTunes counterparts when the entry has them.
+func overrideEntry(entry string, o *ItemOverride) (string, error) {
+	node, err := feedfmt.ParseItem(entry)
+	if err != nil {
+		return "", err
+	}
+	if o.Title != "" {
+		feedfmt.SetChildText(node, "title", o.Title)
+		if n := node.SelectElement("itunes:title"); n != nil {
+			feedfmt.SetText(n, o.Title)
+		}
+	}
+	if o.Description != "" {
+		feedfmt.SetChildText(node, "description", o.Description)
+		for _, name := range []string{"itunes:summary", "content:encoded"} {
+			if n := node.SelectElement(name); n != nil {
+				feedfmt.SetText(n, o.Description)
+			}
+		}
+	}
+	return feedfmt.OutputXML(node), nil
+}
+
+// pinFirst moves pinned items to the top, keeping the order otherwise.
+func pinFirst(items []Item, overrides map[int64]*ItemOverride) []Item {
+	if len(overrides) == 0 {
+		return items
+	}
+	sorted := make([]Item, 0, len(items))
+	for _, item := range items {
+		if o, ok := overrides[item.ID]; ok && o.Pinned {
+			sorted = append(sorted, item)
+		}
+	}
+	for _, item := range items {
+		if o, ok := overrides[item.ID]; !ok || !o.Pinned {
+			sorted = append(sorted, item)
+		}
+	}
+	return sorted
+}
+
+// ItemCtx loads the item of the request, which must belong to the source of
+// the request.
+func ItemCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		source := r.Context().Value("source").(Source)
+		itemID, err := strconv.ParseInt(chi.URLParam(r, "itemID"), 10, 64)
+		if err != nil {
+			http.Error(w, http.StatusText(400), 400)
+			return
+		}
+		item, err := DbGetItem(itemID)
+		if err != nil || item.FeedID != source.ID {
+			http.Error(w, http.StatusText(404), 404)
+			return
+		}
+		ctx := context.WithValue(r.Context(), "item", item)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// saveOverride stores an override, deleting it when it no longer changes the
+// item.
+func saveOverride(override *ItemOverride) error {
+	if override.empty() {
+		return DbDeleteItemOverride(override.ItemID)
+	}
+	override.UpdatedAt = time.Now()
+	return DbSaveItemOverride(override)
+}
+
+func currentOverride(itemID int64) (ItemOverride, error) {
+	override, err := DbGetItemOverride(itemID)
+	if err == ErrNotFound {
+		return ItemOverride{ItemID: itemID}, nil
+	}
+	return override, err
+}
+
+func updateItemFormHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	source := ctx.Value("source").(Source)
+	item := ctx.Value("item").(Item)
+
+	override, err := currentOverride(item.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = renderTemplate(w, r, "edit_item.html", map[string]interface{}{
+		"source":   source,
+		"item":     item,
+		"override": override,
+	})
+	if err != nil {
+		fmt.Printf("\nRender Error: %v\n", err)
+		return
+	}
+}
+
+// updateItemHandler changes the override of an item. The action field hides,
+// pins or resets the item, otherwise the whole form is saved.
+func updateItemHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	source := ctx.Value("source").(Source)
+	item := ctx.Value("item").(Item)
+
+	override, err := currentOverride(item.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	r.ParseForm()
+	switch r.Form.Get("action") {
+	case "hide", "unhide":
+		override.Hidden = r.Form.Get("action") == "hide"
+	case "pin", "unpin":
+		override.Pinned = r.Form.Get("action") == "pin"
+	case "reset":
+		override = ItemOverride{ItemID: item.ID}
+	case "":
+		override.Hidden = r.Form.Get("hidden") != ""
+		override.Pinned = r.Form.Get("pinned") != ""
+		override.Title = strings.TrimSpace(r.Form.Get("title"))
+		override.Description = strings.TrimSpace(r.Form.Get("description"))
+	default:
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+
+	err = saveOverride(&override)
+	if err != nil {
+		log.Printf("cannot save item override, err=%s", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	err = saveFlash(w, r, fmt.Sprintf("item id: %d updated", item.ID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/feeds/%d/items", source.ID), http.StatusSeeOther)
+}
+
+// ApiItemCtx loads the item of the request like ItemCtx, answering with JSON
+// errors.
+func ApiItemCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		source := r.Context().Value("source").(Source)
+		itemID, err := strconv.ParseInt(chi.URLParam(r, "itemID"), 10, 64)
+		if err != nil {
+			render.Render(w, r, ErrInvalidRequest(fmt.Errorf("invalid item id")))
+			return
+		}
+		item, err := DbGetItem(itemID)
+		if err == ErrNotFound || (err == nil && item.FeedID != source.ID) {
+			render.Render(w, r, ErrResourceNotFound)
+			return
+		}
+		if err != nil {
+			render.Render(w, r, ErrInternal(err))
+			return
+		}
+		ctx := context.WithValue(r.Context(), "item", item)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+type ItemOverrideResponse struct {
+	*ItemOverride
+}
+
+func (rd *ItemOverrideResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// ItemOverrideRequest replaces the override of an item, fields left out are
+// cleared.
+type ItemOverrideRequest struct {
+	Hidden      bool   `json:"hidden"`
+	Pinned      bool   `json:"pinned"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+func (req *ItemOverrideRequest) Bind(r *http.Request) error {
+	return nil
+}
+
+func getItemOverrideHandler(w http.ResponseWriter, r *http.Request) {
+	item := r.Context().Value("item").(Item)
+
+	override, err := currentOverride(item.ID)
+	if err != nil {
+		render.Render(w, r, ErrInternal(err))
+		return
+	}
+	if err := render.Render(w, r, &ItemOverrideResponse{&override}); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+func putItemOverrideHandler(w http.ResponseWriter, r *http.Request) {
+	item := r.Context().Value("item").(Item)
+
+	var req ItemOverrideRequest
+	if err := render.Bind(r, &req); err != nil {
+		render.Render(w, r, ErrInvalidRequest(err))
+		return
+	}
+
+	override := ItemOverride{
+		ItemID:      item.ID,
+		Hidden:      req.Hidden,
+		Pinned:      req.Pinned,
+		Title:       strings.TrimSpace(req.Title),
+		Description: strings.TrimSpace(req.Description),
+	}
+	if err := saveOverride(&override); err != nil {
+		render.Render(w, r, ErrInternal(err))
+		return
+	}
+	if err := render.Render(w, r, &ItemOverrideResponse{&override}); err != nil {
+		render.Render(w, r, ErrRender(err))
+		return
+	}
+}
+
+func deleteItemOverrideHandler(w http.ResponseWriter, r *http.Request) {
+	item := r.Context().Value("item").(Item)
+
+	if err := DbDeleteItemOverride(item.ID); err != nil {
+		render.Render(w, r, ErrInternal(err))
+		return
+	}
+	render.NoContent(w, r)
+}
@@ -0,0 +1,294 @@
+package feed
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/wiennat/rjio/pkg/feedfmt"
+)
+
+const defaultPublishPeriod = 24 * time.Hour
+
+// PublishConfig limits how many items of each source a channel publishes over
+// time. Items waiting for their turn are left out of the channel until then.
+type PublishConfig struct {
+	// MaxPerSource is the number of items of a source published per Period,
+	// zero publishes every item as soon as it is ready
+	MaxPerSource int `yaml:"max-per-source"`
+	// Period defaults to a day
+	Period time.Duration `yaml:"period"`
+}
+
+// validatePublishing checks that publish delays and rate limits are not
+// negative.
+func validatePublishing(config *Config) error {
+	limits := map[string]PublishConfig{"channel": config.Channel.Publish}
+	for slug, channel := range config.Channels {
+		limits["channel "+slug] = channel.Publish
+	}
+	for name, limit := range limits {
+		if limit.MaxPerSource < 0 || limit.Period < 0 {
+			return fmt.Errorf("publish limit of %s cannot be negative", name)
+		}
+	}
+	for slug, source := range config.Sources {
+		if source.PublishDelay < 0 {
+			return fmt.Errorf("publish-delay of source %s cannot be negative", slug)
+		}
+	}
+	return nil
+}
+
+// channelPublishing returns the publish limit of a channel, the default
+// channel has an empty slug.
+func channelPublishing(slug string) PublishConfig {
+	if slug == "" {
+		return cfg.Channel.Publish
+	}
+	return cfg.Channels[slug].Publish
+}
+
+// publishSettingName names the stored setting of a channel limit or a source
+// delay.
+func publishSettingName(kind string, slug string) string {
+	return kind + ":" + slug
+}
+
+// publishSince maps the publish settings in effect to the time they took
+// effect, items first seen before are published as they come.
+var publishSince map[string]time.Time
+
+// loadPublishSettings records since when each publish delay and limit of
+// config is in effect. Settings keep their time across restarts and start
+// over once removed from the config.
+func loadPublishSettings(config *Config) error {
+	names := make(map[string]bool)
+	if config.Channel.Publish.MaxPerSource > 0 {
+		names[publishSettingName("channel", "")] = true
+	}
+	for slug, channel := range config.Channels {
+		if channel.Publish.MaxPerSource > 0 {
+			names[publishSettingName("channel", slug)] = true
+		}
+	}
+	for slug, source := range config.Sources {
+		if source.PublishDelay > 0 {
+			names[publishSettingName("source", slug)] = true
+		}
+	}
+
+	settings, err := DbListPublishSettings()
+	if err != nil {
+		return err
+	}
+	since := make(map[string]time.Time, len(names))
+	for _, setting := range settings {
+		if !names[setting.Name] {
+			if err := DbDeletePublishSetting(setting.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		since[setting.Name] = setting.Since
+	}
+	now := time.Now()
+	for name := range names {
+		if _, ok := since[name]; ok {
+			continue
+		}
+		if err := DbCreatePublishSetting(&PublishSetting{Name: name, Since: now}); err != nil {
+			return err
+		}
+		since[name] = now
+	}
+	publishSince = since
+	return nil
+}
+
+// publishSchedule is what a channel publishes its items by.
+type publishSchedule struct {
+	limit PublishConfig
+	// limitSince is when the limit took effect
+	limitSince time.Time
+	// delays and delaySince hold the publish delay of sources by id and when
+	// it took effect
+	delays     map[int64]time.Duration
+	delaySince map[int64]time.Time
+	// published holds the time items already published were published at
+	published map[int64]time.Time
+}
+
+// channelSchedule loads the publish schedule of the channel with the given
+// slug.
+func channelSchedule(slug string) (publishSchedule, error) {
+	schedule := publishSchedule{
+		limit:      channelPublishing(slug),
+		limitSince: publishSince[publishSettingName("channel", slug)],
+		delays:     make(map[int64]time.Duration),
+		delaySince: make(map[int64]time.Time),
+	}
+	if len(cfg.Sources) > 0 {
+		for _, source := range DbListSource() {
+			if delay := cfg.Sources[source.Slug].PublishDelay; delay > 0 {
+				schedule.delays[source.ID] = delay
+				schedule.delaySince[source.ID] = publishSince[publishSettingName("source", source.Slug)]
+			}
+		}
+	}
+
+	publications, err := DbListItemPublications(slug)
+	if err != nil {
+		return schedule, err
+	}
+	schedule.published = make(map[int64]time.Time, len(publications))
+	for _, p := range publications {
+		schedule.published[p.ItemID] = p.PublishedAt
+	}
+	return schedule, nil
+}
+
+// publishChannelItems publishes items in the channel with the given slug.
+// When record is set, it stores when the items published for the first time
+// were published, so that they keep that time.
+func publishChannelItems(slug string, items []Item, now time.Time, record bool) ([]Item, []FilteredItem, error) {
+	schedule, err := channelSchedule(slug)
+	if err != nil {
+		return nil, nil, err
+	}
+	kept, scheduled, published := schedulePublishing(items, schedule, now)
+	if !record {
+		return kept, scheduled, nil
+	}
+	for itemID, publishedAt := range published {
+		err := DbSaveItemPublication(&ItemPublication{Channel: slug, ItemID: itemID, PublishedAt: publishedAt})
+		if err != nil {
+			// the item is published again at the same time next time
+			log.Printf("cannot save publication of item %d, err=%v", itemID, err)
+		}
+	}
+	return kept, scheduled, nil
+}
+
+// schedulePublishing computes when items are published in a channel: an item
+// is ready once the publish delay of its source has passed since it was first
+// seen, then waits until its source has published fewer than MaxPerSource
+// items within the last Period. A delay or limit only applies to the items
+// first seen after it took effect, items it does not apply to keep their
+// dates.
+//
+// Items published by now are returned newest first and served with the later
+// of their pubDate and the time they were published, the others are left
+// out. The items published for the first time are returned with that time,
+// which is kept from then on.
+func schedulePublishing(items []Item, schedule publishSchedule, now time.Time) ([]Item, []FilteredItem, map[int64]time.Time) {
+	limit := schedule.limit
+	if len(schedule.delays) == 0 && limit.MaxPerSource == 0 && len(schedule.published) == 0 {
+		return items, nil, nil
+	}
+	period := limit.Period
+	if period == 0 {
+		period = defaultPublishPeriod
+	}
+
+	// items already published keep their time, the others wait for the
+	// delay and the limit that apply to them
+	publishAt := make([]time.Time, len(items))
+	scheduled := make([]bool, len(items))
+	limited := make(map[int64][]int)
+	for i := range items {
+		item := &items[i]
+		if t, ok := schedule.published[item.ID]; ok {
+			publishAt[i] = t
+			limited[item.FeedID] = append(limited[item.FeedID], i)
+			continue
+		}
+		seen := item.FirstSeenAt
+		if seen.IsZero() {
+			seen = item.PubDate
+		}
+		delay, ok := schedule.delays[item.FeedID]
+		if ok && !seen.Before(schedule.delaySince[item.FeedID]) {
+			publishAt[i] = seen.Add(delay)
+			scheduled[i] = true
+		}
+		if limit.MaxPerSource > 0 && !seen.Before(schedule.limitSince) {
+			if !scheduled[i] {
+				publishAt[i] = seen
+			}
+			scheduled[i] = true
+			limited[item.FeedID] = append(limited[item.FeedID], i)
+		}
+	}
+
+	if max := limit.MaxPerSource; max > 0 {
+		for _, indexes := range limited {
+			// published items come first, then the oldest items of a source
+			sort.SliceStable(indexes, func(a, b int) bool {
+				i, j := indexes[a], indexes[b]
+				if scheduled[i] != scheduled[j] {
+					return !scheduled[i]
+				}
+				if !publishAt[i].Equal(publishAt[j]) {
+					return publishAt[i].Before(publishAt[j])
+				}
+				return items[i].PubDate.Before(items[j].PubDate)
+			})
+			for n, i := range indexes {
+				if !scheduled[i] || n == 0 {
+					continue
+				}
+				if prev := publishAt[indexes[n-1]]; prev.After(publishAt[i]) {
+					publishAt[i] = prev
+				}
+				if n >= max {
+					if next := publishAt[indexes[n-max]].Add(period); next.After(publishAt[i]) {
+						publishAt[i] = next
+					}
+				}
+			}
+		}
+	}
+
+	kept := make([]Item, 0, len(items))
+	var waiting []FilteredItem
+	published := make(map[int64]time.Time)
+	for i, item := range items {
+		if publishAt[i].IsZero() {
+			kept = append(kept, item)
+			continue
+		}
+		if publishAt[i].After(now) {
+			waiting = append(waiting, FilteredItem{Item: item, Rule: "scheduled for " + publishAt[i].Format(time.RFC1123Z)})
+			continue
+		}
+		if scheduled[i] {
+			published[item.ID] = publishAt[i]
+		}
+		if publishAt[i].After(item.PubDate) {
+			entry, err := rescheduleEntry(item.Entry, publishAt[i])
+			if err != nil {
+				log.Printf("cannot set pubDate of item %d, err=%v", item.ID, err)
+			} else {
+				item.Entry = entry
+				item.PubDate = publishAt[i]
+			}
+		}
+		kept = append(kept, item)
+	}
+	sort.SliceStable(kept, func(i, j int) bool {
+		return kept[i].PubDate.After(kept[j].PubDate)
+	})
+	return kept, waiting, published
+}
+
+// rescheduleEntry sets the pubDate of an entry.
+func rescheduleEntry(entry string, pubDate time.Time) (string, error) {
+	node, err := feedfmt.ParseItem(entry)
+	if err != nil {
+		return "", err
+	}
+	feedfmt.SetChildText(node, "pubDate", pubDate.Format(time.RFC1123Z))
+	return feedfmt.OutputXML(node), nil
+}
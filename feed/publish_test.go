@@ -0,0 +1,182 @@
+package feed
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wiennat/rjio/pkg/feedfmt"
+)
+
+func publishItem(id int64, feedID int64, seen time.Time, pubDate time.Time) Item {
+	item := Item{ID: id, FeedID: feedID, FirstSeenAt: seen}
+	item.GUID = "guid"
+	item.PubDate = pubDate
+	item.Entry = "<item><guid>guid</guid><pubDate>" + pubDate.Format(time.RFC1123Z) + "</pubDate></item>"
+	return item
+}
+
+func TestSchedulePublishing(t *testing.T) {
+	now := time.Date(2023, 1, 10, 12, 0, 0, 0, time.UTC)
+	hour := time.Hour
+	day := 24 * time.Hour
+	setAt := now.Add(-10 * day)
+
+	type published struct {
+		id      int64
+		pubDate time.Time
+	}
+	tests := []struct {
+		name      string
+		items     []Item
+		schedule  publishSchedule
+		kept      []published
+		scheduled []int64
+		stored    map[int64]time.Time
+	}{
+		{
+			name:  "no settings",
+			items: []Item{publishItem(1, 1, now.Add(-hour), now.Add(-hour))},
+			kept:  []published{{1, now.Add(-hour)}},
+		},
+		{
+			name: "delay",
+			items: []Item{
+				publishItem(1, 1, now.Add(-2*hour), now.Add(-3*hour)),
+				publishItem(2, 1, now.Add(-7*hour), now.Add(-8*hour)),
+				publishItem(3, 2, now.Add(-hour), now.Add(-hour)),
+			},
+			schedule: publishSchedule{
+				delays:     map[int64]time.Duration{1: 6 * hour},
+				delaySince: map[int64]time.Time{1: setAt},
+			},
+			kept:      []published{{2, now.Add(-hour)}, {3, now.Add(-hour)}},
+			scheduled: []int64{1},
+			stored:    map[int64]time.Time{2: now.Add(-hour)},
+		},
+		{
+			name: "items seen before the delay are not held back",
+			items: []Item{
+				publishItem(1, 1, setAt.Add(-hour), setAt.Add(-hour)),
+				publishItem(2, 1, now.Add(-hour), now.Add(-hour)),
+			},
+			schedule: publishSchedule{
+				delays:     map[int64]time.Duration{1: 6 * hour},
+				delaySince: map[int64]time.Time{1: setAt},
+			},
+			kept:      []published{{1, setAt.Add(-hour)}},
+			scheduled: []int64{2},
+		},
+		{
+			name: "limit",
+			items: []Item{
+				publishItem(1, 1, now.Add(-3*hour), now.Add(-3*hour)),
+				publishItem(2, 1, now.Add(-2*hour), now.Add(-2*hour)),
+				publishItem(3, 1, now.Add(-hour), now.Add(-hour)),
+				publishItem(4, 2, now.Add(-hour), now.Add(-hour)),
+			},
+			schedule: publishSchedule{
+				limit:      PublishConfig{MaxPerSource: 2},
+				limitSince: setAt,
+			},
+			kept:      []published{{4, now.Add(-hour)}, {2, now.Add(-2 * hour)}, {1, now.Add(-3 * hour)}},
+			scheduled: []int64{3},
+			stored: map[int64]time.Time{
+				1: now.Add(-3 * hour),
+				2: now.Add(-2 * hour),
+				4: now.Add(-hour),
+			},
+		},
+		{
+			name: "published items keep their time and count towards the limit",
+			items: []Item{
+				publishItem(1, 1, now.Add(-3*day), now.Add(-3*day)),
+				publishItem(2, 1, now.Add(-2*hour), now.Add(-2*hour)),
+			},
+			schedule: publishSchedule{
+				limit:      PublishConfig{MaxPerSource: 1, Period: 3 * day},
+				limitSince: setAt,
+				delays:     map[int64]time.Duration{1: day},
+				delaySince: map[int64]time.Time{1: setAt},
+				published:  map[int64]time.Time{1: now.Add(-2 * day)},
+			},
+			kept:      []published{{1, now.Add(-2 * day)}},
+			scheduled: []int64{2},
+		},
+		{
+			name: "published items are served once the settings are gone",
+			items: []Item{
+				publishItem(1, 1, now.Add(-3*day), now.Add(-3*day)),
+				publishItem(2, 1, now.Add(-2*hour), now.Add(-2*hour)),
+			},
+			schedule: publishSchedule{
+				published: map[int64]time.Time{1: now.Add(-2 * day)},
+			},
+			kept: []published{{2, now.Add(-2 * hour)}, {1, now.Add(-2 * day)}},
+		},
+		{
+			name:  "later pubDate is kept",
+			items: []Item{publishItem(1, 1, now.Add(-7*hour), now.Add(-30*time.Minute))},
+			schedule: publishSchedule{
+				delays:     map[int64]time.Duration{1: 6 * hour},
+				delaySince: map[int64]time.Time{1: setAt},
+			},
+			kept:   []published{{1, now.Add(-30 * time.Minute)}},
+			stored: map[int64]time.Time{1: now.Add(-hour)},
+		},
+	}
+	for _, tt := range tests {
+		kept, scheduled, stored := schedulePublishing(tt.items, tt.schedule, now)
+		if len(kept) != len(tt.kept) {
+			t.Errorf("%s: kept %d items, want %d", tt.name, len(kept), len(tt.kept))
+			continue
+		}
+		for i, want := range tt.kept {
+			if kept[i].ID != want.id || !kept[i].PubDate.Equal(want.pubDate) {
+				t.Errorf("%s: item #%d = %d at %v, want %d at %v", tt.name, i, kept[i].ID, kept[i].PubDate, want.id, want.pubDate)
+			}
+			if !strings.Contains(kept[i].Entry, want.pubDate.Format(time.RFC1123Z)) {
+				t.Errorf("%s: entry of item %d = %s, want pubDate %v", tt.name, kept[i].ID, kept[i].Entry, want.pubDate)
+			}
+		}
+		if len(scheduled) != len(tt.scheduled) {
+			t.Errorf("%s: scheduled %d items, want %d", tt.name, len(scheduled), len(tt.scheduled))
+		} else {
+			for i, id := range tt.scheduled {
+				if scheduled[i].ID != id {
+					t.Errorf("%s: scheduled item #%d = %d, want %d", tt.name, i, scheduled[i].ID, id)
+				}
+			}
+		}
+		if len(stored) != len(tt.stored) {
+			t.Errorf("%s: published %v, want %v", tt.name, stored, tt.stored)
+			continue
+		}
+		for id, want := range tt.stored {
+			if !stored[id].Equal(want) {
+				t.Errorf("%s: item %d published at %v, want %v", tt.name, id, stored[id], want)
+			}
+		}
+	}
+}
+
+func TestSchedulePublishingBadEntry(t *testing.T) {
+	now := time.Date(2023, 1, 10, 12, 0, 0, 0, time.UTC)
+	item := publishItem(1, 1, now.Add(-7*time.Hour), now.Add(-7*time.Hour))
+	item.Entry = "<item><title>a & b</title></item>"
+	schedule := publishSchedule{
+		delays:     map[int64]time.Duration{1: 6 * time.Hour},
+		delaySince: map[int64]time.Time{1: now.Add(-24 * time.Hour)},
+	}
+
+	kept, _, stored := schedulePublishing([]Item{item}, schedule, now)
+	if len(kept) != 1 || kept[0].Entry != item.Entry || !kept[0].PubDate.Equal(item.PubDate) {
+		t.Errorf("kept %+v, want the item as stored", kept)
+	}
+	if _, err := feedfmt.ParseItem(item.Entry); err == nil {
+		t.Fatalf("entry %s parses, want a bad entry", item.Entry)
+	}
+	if !stored[1].Equal(now.Add(-time.Hour)) {
+		t.Errorf("published %v, want item 1 at %v", stored, now.Add(-time.Hour))
+	}
+}
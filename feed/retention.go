@@ -0,0 +1,127 @@
+package feed
+
+import (
+	"log"
+	"time"
+)
+
+const defaultPruneInterval = time.Hour
+
+// RetentionConfig limits how many items are kept. Zero values keep
+// everything.
+type RetentionConfig struct {
+	// MaxItems keeps the newest items of each source
+	MaxItems int `yaml:"max-items"`
+	// MaxAgeDays drops items published more than this many days ago
+	MaxAgeDays int `yaml:"max-age-days"`
+	// RemovedGrace drops items removed upstream this long ago
+	RemovedGrace time.Duration `yaml:"removed-grace"`
+	// MaxFeedItems caps the number of items served in a feed, it is only
+	// read from the global settings
+	MaxFeedItems int `yaml:"max-feed-items"`
+	// Interval is the time between two pruning runs, only read from the
+	// global settings
+	Interval time.Duration `yaml:"interval"`
+}
+
+// validateRetention checks that no limit is negative.
+func validateRetention(name string, r RetentionConfig) {
+	if r.MaxItems < 0 || r.MaxAgeDays < 0 || r.RemovedGrace < 0 || r.MaxFeedItems < 0 || r.Interval < 0 {
+		log.Fatalf("invalid retention for %s: limits cannot be negative", name)
+	}
+}
+
+// retentionFor returns the retention of source, settings of the source
+// override the global ones.
+func retentionFor(source Source) RetentionConfig {
+	retention := cfg.Retention
+	override := cfg.Sources[source.Slug].Retention
+	if override.MaxItems > 0 {
+		retention.MaxItems = override.MaxItems
+	}
+	if override.MaxAgeDays > 0 {
+		retention.MaxAgeDays = override.MaxAgeDays
+	}
+	if override.RemovedGrace > 0 {
+		retention.RemovedGrace = override.RemovedGrace
+	}
+	return retention
+}
+
+// capFeedItems keeps the first items of a feed up to the configured maximum.
+func capFeedItems(items []Item) []Item {
+	if max := cfg.Retention.MaxFeedItems; max > 0 && len(items) > max {
+		return items[:max]
+	}
+	return items
+}
+
+type Pruner struct {
+	Config *Config
+}
+
+func SetupPruner(c *Config) *Pruner {
+	cfg = c
+	validateRetention("all sources", c.Retention)
+	for slug, source := range c.Sources {
+		validateRetention("source "+slug, source.Retention)
+	}
+	return &Pruner{Config: c}
+}
+
+// Start prunes the items of every source periodically.
+func (p Pruner) Start() {
+	interval := p.Config.Retention.Interval
+	if interval <= 0 {
+		interval = defaultPruneInterval
+	}
+	go func() {
+		for now := range time.Tick(interval) {
+			p.Prune(now)
+		}
+	}()
+}
+
+// Prune deletes the items of every source that fall outside its retention.
+func (p Pruner) Prune(now time.Time) {
+	for _, source := range DbListSource() {
+		n, err := pruneSource(source, now)
+		if err != nil {
+			log.Printf("Error during pruning items of %s, err=%v", source, err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("Pruned %d items, source=%s", n, source)
+		}
+	}
+}
+
+func pruneSource(source Source, now time.Time) (int64, error) {
+	retention := retentionFor(source)
+	var total int64
+
+	if retention.MaxAgeDays > 0 {
+		n, err := DbDeleteItemsPublishedBefore(source.ID, now.AddDate(0, 0, -retention.MaxAgeDays))
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+
+	if retention.RemovedGrace > 0 {
+		n, err := DbDeleteItemsRemovedBefore(source.ID, now.Add(-retention.RemovedGrace))
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+
+	if retention.MaxItems > 0 {
+		n, err := DbDeleteItemsBeyond(source.ID, retention.MaxItems)
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
@@ -0,0 +1,120 @@
+package feed
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antchfx/xmlquery"
+)
+
+// maxBackoffShift caps the exponent so the shifted interval cannot overflow.
+const maxBackoffShift = 16
+
+var updatePeriods = map[string]time.Duration{
+	"hourly":  time.Hour,
+	"daily":   24 * time.Hour,
+	"weekly":  7 * 24 * time.Hour,
+	"monthly": 30 * 24 * time.Hour,
+	"yearly":  365 * 24 * time.Hour,
+}
+
+// Due reports whether the source should be fetched at now.
+func (s Source) Due(now time.Time) bool {
+	return s.NextFetchAt.IsZero() || !s.NextFetchAt.After(now)
+}
+
+// Active reports whether the source is enabled and not paused at now.
+func (s Source) Active(now time.Time) bool {
+	return s.Enabled && !s.PausedUntil.After(now)
+}
+
+// tick returns how often the scheduler looks for due sources.
+func (f Fetcher) tick() time.Duration {
+	tick := f.Config.Fetcher.Tick
+	if tick <= 0 {
+		tick = defaultTick
+	}
+	if interval := f.Config.Fetcher.Interval; interval > 0 && interval < tick {
+		tick = interval
+	}
+	return tick
+}
+
+// interval returns the time between two successful fetches of source. The
+// source override wins over the global interval, but never below what the
+// feed itself asks for.
+func (f Fetcher) interval(source *Source) time.Duration {
+	interval := f.Config.Fetcher.Interval
+	if source.FetchInterval > 0 {
+		interval = source.FetchInterval
+	}
+	if source.UpstreamInterval > interval {
+		interval = source.UpstreamInterval
+	}
+	if interval <= 0 {
+		interval = defaultTick
+	}
+	return interval
+}
+
+// schedule records the outcome of a fetch and computes when source should be
+// fetched again, backing off exponentially while it keeps failing.
+func (f Fetcher) schedule(source *Source, err error, now time.Time) {
+	source.LastFetchedAt = now
+	if err == nil {
+		source.FailureCount = 0
+		source.LastError = ""
+		source.NextFetchAt = now.Add(f.interval(source))
+		return
+	}
+
+	source.FailureCount++
+	source.LastError = err.Error()
+
+	maxBackoff := f.Config.Fetcher.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+	shift := source.FailureCount - 1
+	if shift > maxBackoffShift {
+		shift = maxBackoffShift
+	}
+	delay := f.interval(source) << uint(shift)
+	if delay <= 0 || delay > maxBackoff {
+		delay = maxBackoff
+	}
+	source.NextFetchAt = now.Add(delay)
+}
+
+// upstreamInterval reads the refresh hints a feed publishes in <ttl> or in
+// the syndication module, returning zero when there are none.
+func upstreamInterval(doc *xmlquery.Node) time.Duration {
+	channel := xmlquery.FindOne(doc, "//channel")
+	if channel == nil {
+		return 0
+	}
+
+	var interval time.Duration
+	if n := channel.SelectElement("ttl"); n != nil {
+		if minutes, err := strconv.Atoi(strings.TrimSpace(n.InnerText())); err == nil && minutes > 0 {
+			interval = time.Duration(minutes) * time.Minute
+		}
+	}
+
+	if n := channel.SelectElement("sy:updatePeriod"); n != nil {
+		period, ok := updatePeriods[strings.ToLower(strings.TrimSpace(n.InnerText()))]
+		if ok {
+			frequency := 1
+			if n := channel.SelectElement("sy:updateFrequency"); n != nil {
+				if v, err := strconv.Atoi(strings.TrimSpace(n.InnerText())); err == nil && v > 0 {
+					frequency = v
+				}
+			}
+			if hint := period / time.Duration(frequency); hint > interval {
+				interval = hint
+			}
+		}
+	}
+	return interval
+}
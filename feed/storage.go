@@ -1,12 +1,16 @@
 package feed
 
 import (
+	"errors"
 	"log"
 	"os"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"xorm.io/core"
 	"xorm.io/xorm"
+
+	"github.com/wiennat/rjio/pkg/feedfmt"
 )
 
 type Storage interface {
@@ -14,16 +18,59 @@ type Storage interface {
 	ListSource() []Source
 	CreateSource(source *Source) error
 	UpdateSource(source *Source) error
+	UpdateSourceFetchState(source *Source) error
+	UpdateSourceState(source *Source) error
 	DeleteSource(id int64) error
 	CreateItem(item *Item) error
 	UpdateItem(item *Item) error
 	DeleteItem(item *Item) error
 	GetSourceItems(sourceID int64, offset int, limit int) ([]Item, error)
+	ListSourceItems(sourceID int64, since time.Time, offset int, limit int) ([]Item, error)
 	UpsertSourceItem(item *Item) (int64, error)
 	DeleteItemsBySource(sourceID int64) (int64, error)
+	DeleteItemsPublishedBefore(sourceID int64, before time.Time) (int64, error)
+	DeleteItemsRemovedBefore(sourceID int64, before time.Time) (int64, error)
+	MarkMissingItems(sourceID int64, parsedAt time.Time, removedAfter int, now time.Time) error
+	ListRemovedItems(sourceID int64) ([]Item, error)
+	RestoreItem(id int64) error
+	DeleteItemsBeyond(sourceID int64, keep int) (int64, error)
 	GetItemsForCustomFeed(offset int, limit int) ([]Item, error)
+	GetItemsForChannel(channel *Channel, offset int, limit int) ([]Item, error)
+	ListChannel() ([]Channel, error)
+	GetChannel(id int64) (Channel, error)
+	GetChannelBySlug(slug string) (Channel, error)
+	CreateChannel(channel *Channel) error
+	UpdateChannel(channel *Channel) error
+	DeleteChannel(id int64) error
+	GetChannelSourceIDs(channelID int64) ([]int64, error)
+	SetChannelSources(channelID int64, sourceIDs []int64) error
+	GetItem(id int64) (Item, error)
+	CreateHit(hit *Hit) error
+	ListHits(from time.Time, to time.Time, sourceID int64) ([]Hit, error)
+	GetItems(ids []int64) ([]Item, error)
+	GetItemOverride(itemID int64) (ItemOverride, error)
+	ListItemOverrides() ([]ItemOverride, error)
+	SaveItemOverride(override *ItemOverride) error
+	DeleteItemOverride(itemID int64) error
+	ListItemPublications(channel string) ([]ItemPublication, error)
+	SaveItemPublication(publication *ItemPublication) error
+	ListPublishSettings() ([]PublishSetting, error)
+	CreatePublishSetting(setting *PublishSetting) error
+	DeletePublishSetting(id int64) error
+	ListApiTokens() ([]ApiToken, error)
+	GetApiTokenByHash(hash string) (ApiToken, error)
+	CreateApiToken(token *ApiToken) error
+	DeleteApiToken(id int64) error
+	TouchApiToken(id int64, usedAt time.Time) error
 }
 
+// hiddenSourcesCond leaves out the items of disabled sources hiding them,
+// it takes the values false and true.
+const hiddenSourcesCond = "feed_id NOT IN (SELECT id FROM source WHERE enabled = ? AND hide_items = ?)"
+
+// ErrNotFound is returned when a requested record does not exist
+var ErrNotFound = errors.New("not found")
+
 type SqlStorage struct {
 	engine *xorm.Engine
 	dbConf *DatabaseConfig
@@ -37,6 +84,10 @@ func SetupSqlStorage(config *Config) *SqlStorage {
 		log.Fatal("cannot start db")
 		os.Exit(1)
 	}
+	if dbConf.Driver == "sqlite3" {
+		// sqlite allows a single writer, serialize access from fetch workers
+		engine.SetMaxOpenConns(1)
+	}
 	err = engine.Sync2(new(Source))
 	if err != nil {
 		log.Fatalf("cannot sync db: %s", err)
@@ -47,12 +98,48 @@ func SetupSqlStorage(config *Config) *SqlStorage {
 		log.Fatalf("cannot sync db: %s", err)
 		os.Exit(1)
 	}
+	err = engine.Sync2(new(Channel), new(ChannelSource))
+	if err != nil {
+		log.Fatalf("cannot sync db: %s", err)
+		os.Exit(1)
+	}
+	err = engine.Sync2(new(Hit))
+	if err != nil {
+		log.Fatalf("cannot sync db: %s", err)
+		os.Exit(1)
+	}
+	err = engine.Sync2(new(ApiToken))
+	if err != nil {
+		log.Fatalf("cannot sync db: %s", err)
+		os.Exit(1)
+	}
+	err = engine.Sync2(new(ItemOverride))
+	if err != nil {
+		log.Fatalf("cannot sync db: %s", err)
+		os.Exit(1)
+	}
+	err = engine.Sync2(new(PrunedItem))
+	if err != nil {
+		log.Fatalf("cannot sync db: %s", err)
+		os.Exit(1)
+	}
+	err = engine.Sync2(new(ItemPublication), new(PublishSetting))
+	if err != nil {
+		log.Fatalf("cannot sync db: %s", err)
+		os.Exit(1)
+	}
 	return &SqlStorage{
 		engine: engine,
 		dbConf: dbConf,
 	}
 }
 
+// dbTime formats a time for comparing with a stored one, times are stored as
+// text in the database time zone.
+func (s *SqlStorage) dbTime(t time.Time) string {
+	return t.In(s.engine.DatabaseTZ).Format("2006-01-02 15:04:05")
+}
+
 // func getEngine() (*xorm.Engine, error) {
 // 	engine, err := xorm.NewEngine(dbConf.Driver, dbConf.Filename)
 // 	engine.SetMapper(core.GonicMapper{})
@@ -60,8 +147,11 @@ func SetupSqlStorage(config *Config) *SqlStorage {
 // }
 
 func (s *SqlStorage) GetSource(id int64) (Source, error) {
-	var feed = Source{ID: id}
-	_, err := s.engine.Get(&feed)
+	var feed Source
+	found, err := s.engine.Id(id).Get(&feed)
+	if err == nil && !found {
+		err = ErrNotFound
+	}
 	return feed, err
 }
 
@@ -81,12 +171,33 @@ func (s *SqlStorage) CreateSource(source *Source) error {
 }
 
 func (s *SqlStorage) UpdateSource(source *Source) error {
-	_, err := s.engine.Id(source.ID).Update(source)
+	_, err := s.engine.Id(source.ID).MustCols("fetch_interval").Update(source)
+	return err
+}
+
+// UpdateSourceFetchState stores the fetch bookkeeping columns of a source,
+// including empty values which a plain Update would skip.
+func (s *SqlStorage) UpdateSourceFetchState(source *Source) error {
+	_, err := s.engine.Id(source.ID).Cols(
+		"etag", "last_modified", "content_hash", "parser_version",
+		"upstream_interval", "last_fetched_at", "next_fetch_at", "failure_count", "last_error",
+		"parsed_at",
+	).Update(source)
+	return err
+}
+
+// UpdateSourceState stores whether a source is enabled or paused.
+func (s *SqlStorage) UpdateSourceState(source *Source) error {
+	_, err := s.engine.Id(source.ID).Cols("enabled", "paused_until", "hide_items").Update(source)
 	return err
 }
 
 func (s *SqlStorage) DeleteSource(id int64) error {
 	_, err := s.engine.Id(id).Delete(&Source{})
+	if err != nil {
+		return err
+	}
+	_, err = s.engine.Where("source_id = ?", id).Delete(&ChannelSource{})
 	return err
 }
 
@@ -112,29 +223,417 @@ func (s *SqlStorage) GetSourceItems(sourceID int64, offset int, limit int) ([]It
 
 }
 
+// ListSourceItems returns the items of a source published after since, the
+// newest first.
+func (s *SqlStorage) ListSourceItems(sourceID int64, since time.Time, offset int, limit int) ([]Item, error) {
+	var items []Item
+	session := s.engine.Where("feed_id = ?", sourceID)
+	if !since.IsZero() {
+		session = session.And("pub_date > ?", s.dbTime(since))
+	}
+	err := session.OrderBy("pub_date DESC, id DESC").Limit(limit, offset).Find(&items)
+	return items, err
+}
+
 func (s *SqlStorage) UpsertSourceItem(item *Item) (int64, error) {
 	// find by feed id and guid
-	old := Item{GUID: item.GUID, FeedID: item.FeedID}
+	old := Item{FeedID: item.FeedID}
+	old.GUID = item.GUID
 	found, err := s.engine.Get(&old)
 	if err != nil {
-		log.Fatalf("error finding feed item, %s", err)
+		return 0, err
+	}
+	if !found {
+		// pruned items are not stored again while upstream still lists them
+		pruned, err := s.engine.Exist(&PrunedItem{FeedID: item.FeedID, GUID: item.GUID})
+		if err != nil {
+			return 0, err
+		}
+		if pruned {
+			return 0, nil
+		}
 	}
+	item.FirstSeenAt = old.FirstSeenAt
+	if item.FirstSeenAt.IsZero() {
+		item.FirstSeenAt = time.Now()
+	}
+	if item.PubDate.IsZero() {
+		item.PubDate = item.FirstSeenAt
+		// serve the same date podcast apps sort by
+		if node, err := feedfmt.ParseItem(item.Entry); err != nil {
+			log.Printf("cannot set pubDate of item %s, err=%v", item.GUID, err)
+		} else {
+			feedfmt.SetChildText(node, "pubDate", item.PubDate.Format(time.RFC1123Z))
+			item.Entry = feedfmt.OutputXML(node)
+		}
+	}
+
 	if found {
 		// update
-		log.Printf("update item(%d), %s, %s\n", item.ID, item.FeedID, item.EnclosureUrl)
-		return s.engine.Id(old.ID).Update(item)
+		log.Printf("update item(%d), %d, %s\n", old.ID, item.FeedID, item.EnclosureUrl)
+		// an item seen again is no longer missing
+		return s.engine.Id(old.ID).MustCols("warning", "missing_count", "removed_at").Update(item)
 	}
 
 	return s.engine.Insert(item)
 }
 func (s *SqlStorage) DeleteItemsBySource(sourceID int64) (int64, error) {
-	return s.engine.Where("feed_id = ?", sourceID).Delete(&Item{})
+	_, err := s.engine.Where("item_id IN (SELECT id FROM item WHERE feed_id = ?)", sourceID).Delete(&ItemOverride{})
+	if err != nil {
+		return 0, err
+	}
+	_, err = s.engine.Where("item_id IN (SELECT id FROM item WHERE feed_id = ?)", sourceID).Delete(&ItemPublication{})
+	if err != nil {
+		return 0, err
+	}
+	n, err := s.engine.Where("feed_id = ?", sourceID).Delete(&Item{})
+	if err != nil {
+		return n, err
+	}
+	_, err = s.engine.Where("feed_id = ?", sourceID).Delete(&PrunedItem{})
+	return n, err
+}
+
+func (s *SqlStorage) DeleteItemsPublishedBefore(sourceID int64, before time.Time) (int64, error) {
+	return s.pruneItems(sourceID, "feed_id = ? AND pub_date < ?", sourceID, s.dbTime(before))
+}
+
+// pruneItems deletes the items of a source matching query along with their
+// overrides, and records them as pruned.
+func (s *SqlStorage) pruneItems(sourceID int64, query string, args ...interface{}) (int64, error) {
+	session := s.engine.NewSession()
+	defer session.Close()
+
+	err := session.Begin()
+	if err != nil {
+		return 0, err
+	}
+	var items []Item
+	err = session.Cols("id", "guid").Where(query, args...).Find(&items)
+	if err != nil || len(items) == 0 {
+		session.Rollback()
+		return 0, err
+	}
+
+	now := time.Now()
+	ids := make([]int64, 0, len(items))
+	for _, item := range items {
+		_, err = session.Insert(&PrunedItem{FeedID: sourceID, GUID: item.GUID, PrunedAt: now})
+		if err != nil {
+			session.Rollback()
+			return 0, err
+		}
+		ids = append(ids, item.ID)
+	}
+	_, err = session.In("item_id", ids).Delete(&ItemOverride{})
+	if err != nil {
+		session.Rollback()
+		return 0, err
+	}
+	_, err = session.In("item_id", ids).Delete(&ItemPublication{})
+	if err != nil {
+		session.Rollback()
+		return 0, err
+	}
+	n, err := session.In("id", ids).Delete(&Item{})
+	if err != nil {
+		session.Rollback()
+		return 0, err
+	}
+	return n, session.Commit()
+}
 
+// DeleteItemsRemovedBefore deletes the items of a source removed upstream
+// before before, along with their overrides. Restored items are kept.
+func (s *SqlStorage) DeleteItemsRemovedBefore(sourceID int64, before time.Time) (int64, error) {
+	const removed = "feed_id = ? AND removed_at IS NOT NULL AND removed_at < ?"
+	_, err := s.engine.Where("item_id IN (SELECT id FROM item WHERE "+removed+")", sourceID, s.dbTime(before)).Delete(&ItemOverride{})
+	if err != nil {
+		return 0, err
+	}
+	_, err = s.engine.Where("item_id IN (SELECT id FROM item WHERE "+removed+")", sourceID, s.dbTime(before)).Delete(&ItemPublication{})
+	if err != nil {
+		return 0, err
+	}
+	return s.engine.Where(removed, sourceID, s.dbTime(before)).Delete(&Item{})
+}
+
+// MarkMissingItems counts a successful fetch for the items of a source not
+// seen when its feed was last parsed at parsedAt, and marks those missing from
+// removedAfter fetches as removed at now.
+func (s *SqlStorage) MarkMissingItems(sourceID int64, parsedAt time.Time, removedAfter int, now time.Time) error {
+	_, err := s.engine.Exec("UPDATE item SET missing_count = missing_count + 1 "+
+		"WHERE feed_id = ? AND last_seen_at IS NOT NULL AND last_seen_at < ?", sourceID, s.dbTime(parsedAt))
+	if err != nil {
+		return err
+	}
+	_, err = s.engine.Exec("UPDATE item SET removed_at = ? "+
+		"WHERE feed_id = ? AND missing_count >= ? AND removed_at IS NULL AND restored = ?", s.dbTime(now), sourceID, removedAfter, false)
+	return err
+}
+
+func (s *SqlStorage) ListRemovedItems(sourceID int64) ([]Item, error) {
+	var items []Item
+	err := s.engine.Where("feed_id = ? AND removed_at IS NOT NULL", sourceID).OrderBy("removed_at DESC").Find(&items)
+	return items, err
+}
+
+// RestoreItem serves an item removed upstream again.
+func (s *SqlStorage) RestoreItem(id int64) error {
+	_, err := s.engine.Id(id).Cols("removed_at", "restored").Update(&Item{Restored: true})
+	return err
+}
+
+// DeleteItemsBeyond deletes the items of a source but the newest keep.
+func (s *SqlStorage) DeleteItemsBeyond(sourceID int64, keep int) (int64, error) {
+	return s.pruneItems(sourceID, "feed_id = ? AND id NOT IN "+
+		"(SELECT id FROM item WHERE feed_id = ? ORDER BY pub_date DESC, id DESC LIMIT ?)", sourceID, sourceID, keep)
 }
+
 func (s *SqlStorage) GetItemsForCustomFeed(offset int, limit int) ([]Item, error) {
 	// find by feed id and guid
 	var items []Item
-	err := s.engine.OrderBy("pub_date DESC").Limit(limit, offset).Find(&items)
+	err := s.engine.Where(hiddenSourcesCond, false, true).OrderBy("pub_date DESC").Limit(limit, offset).Find(&items)
 
 	return items, err
 }
+
+func (s *SqlStorage) GetItemsForChannel(channel *Channel, offset int, limit int) ([]Item, error) {
+	if channel.AllSources {
+		return s.GetItemsForCustomFeed(offset, limit)
+	}
+
+	sourceIDs, err := s.GetChannelSourceIDs(channel.ID)
+	if err != nil || len(sourceIDs) == 0 {
+		return nil, err
+	}
+
+	var items []Item
+	err = s.engine.In("feed_id", sourceIDs).And(hiddenSourcesCond, false, true).OrderBy("pub_date DESC").Limit(limit, offset).Find(&items)
+	return items, err
+}
+
+func (s *SqlStorage) ListChannel() ([]Channel, error) {
+	var channels []Channel
+	err := s.engine.OrderBy("slug").Find(&channels)
+	return channels, err
+}
+
+func (s *SqlStorage) GetChannel(id int64) (Channel, error) {
+	var channel Channel
+	found, err := s.engine.Id(id).Get(&channel)
+	if err == nil && !found {
+		err = ErrNotFound
+	}
+	return channel, err
+}
+
+func (s *SqlStorage) GetChannelBySlug(slug string) (Channel, error) {
+	var channel Channel
+	found, err := s.engine.Where("slug = ?", slug).Get(&channel)
+	if err == nil && !found {
+		err = ErrNotFound
+	}
+	return channel, err
+}
+
+func (s *SqlStorage) CreateChannel(channel *Channel) error {
+	_, err := s.engine.Insert(channel)
+	return err
+}
+
+func (s *SqlStorage) UpdateChannel(channel *Channel) error {
+	// the admin form always sends every field, including emptied ones
+	_, err := s.engine.Id(channel.ID).AllCols().Update(channel)
+	return err
+}
+
+func (s *SqlStorage) DeleteChannel(id int64) error {
+	var channel Channel
+	found, err := s.engine.Id(id).Get(&channel)
+	if err != nil || !found {
+		return err
+	}
+	_, err = s.engine.Id(id).Delete(&Channel{})
+	if err != nil {
+		return err
+	}
+	_, err = s.engine.Where("channel_id = ?", id).Delete(&ChannelSource{})
+	if err != nil {
+		return err
+	}
+	_, err = s.engine.Where("channel = ?", channel.Slug).Delete(&ItemPublication{})
+	return err
+}
+
+func (s *SqlStorage) GetChannelSourceIDs(channelID int64) ([]int64, error) {
+	var members []ChannelSource
+	err := s.engine.Where("channel_id = ?", channelID).Find(&members)
+	if err != nil {
+		return nil, err
+	}
+
+	sourceIDs := make([]int64, 0, len(members))
+	for _, member := range members {
+		sourceIDs = append(sourceIDs, member.SourceID)
+	}
+	return sourceIDs, nil
+}
+
+// SetChannelSources replaces the member sources of a channel.
+func (s *SqlStorage) SetChannelSources(channelID int64, sourceIDs []int64) error {
+	session := s.engine.NewSession()
+	defer session.Close()
+
+	err := session.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = session.Where("channel_id = ?", channelID).Delete(&ChannelSource{})
+	if err != nil {
+		session.Rollback()
+		return err
+	}
+	for _, sourceID := range sourceIDs {
+		_, err = session.Insert(&ChannelSource{ChannelID: channelID, SourceID: sourceID})
+		if err != nil {
+			session.Rollback()
+			return err
+		}
+	}
+	return session.Commit()
+}
+
+func (s *SqlStorage) GetItem(id int64) (Item, error) {
+	var item Item
+	found, err := s.engine.Id(id).Get(&item)
+	if err == nil && !found {
+		err = ErrNotFound
+	}
+	return item, err
+}
+
+func (s *SqlStorage) CreateHit(hit *Hit) error {
+	_, err := s.engine.Insert(hit)
+	return err
+}
+
+// ListHits returns the hits recorded in [from, to) ordered by time, of a
+// single source when sourceID is not zero.
+func (s *SqlStorage) ListHits(from time.Time, to time.Time, sourceID int64) ([]Hit, error) {
+	var hits []Hit
+	session := s.engine.Where("created_at >= ? AND created_at < ?", s.dbTime(from), s.dbTime(to))
+	if sourceID != 0 {
+		session = session.And("source_id = ?", sourceID)
+	}
+	err := session.OrderBy("created_at, id").Find(&hits)
+	return hits, err
+}
+
+func (s *SqlStorage) GetItems(ids []int64) ([]Item, error) {
+	var items []Item
+	if len(ids) == 0 {
+		return items, nil
+	}
+	err := s.engine.In("id", ids).Find(&items)
+	return items, err
+}
+
+func (s *SqlStorage) GetItemOverride(itemID int64) (ItemOverride, error) {
+	var override ItemOverride
+	found, err := s.engine.Where("item_id = ?", itemID).Get(&override)
+	if err == nil && !found {
+		err = ErrNotFound
+	}
+	return override, err
+}
+
+func (s *SqlStorage) ListItemOverrides() ([]ItemOverride, error) {
+	var overrides []ItemOverride
+	err := s.engine.Find(&overrides)
+	return overrides, err
+}
+
+// SaveItemOverride stores the override of an item, replacing the one it may
+// already have.
+func (s *SqlStorage) SaveItemOverride(override *ItemOverride) error {
+	old, err := s.GetItemOverride(override.ItemID)
+	if err == ErrNotFound {
+		_, err = s.engine.Insert(override)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	override.ID = old.ID
+	_, err = s.engine.Id(old.ID).AllCols().Update(override)
+	return err
+}
+
+func (s *SqlStorage) DeleteItemOverride(itemID int64) error {
+	_, err := s.engine.Where("item_id = ?", itemID).Delete(&ItemOverride{})
+	return err
+}
+
+func (s *SqlStorage) ListItemPublications(channel string) ([]ItemPublication, error) {
+	var publications []ItemPublication
+	err := s.engine.Where("channel = ?", channel).Find(&publications)
+	return publications, err
+}
+
+// SaveItemPublication stores when an item was published in a channel, unless
+// it is already stored.
+func (s *SqlStorage) SaveItemPublication(publication *ItemPublication) error {
+	found, err := s.engine.Exist(&ItemPublication{Channel: publication.Channel, ItemID: publication.ItemID})
+	if err != nil || found {
+		return err
+	}
+	_, err = s.engine.Insert(publication)
+	return err
+}
+
+func (s *SqlStorage) ListPublishSettings() ([]PublishSetting, error) {
+	var settings []PublishSetting
+	err := s.engine.Find(&settings)
+	return settings, err
+}
+
+func (s *SqlStorage) CreatePublishSetting(setting *PublishSetting) error {
+	_, err := s.engine.Insert(setting)
+	return err
+}
+
+func (s *SqlStorage) DeletePublishSetting(id int64) error {
+	_, err := s.engine.Id(id).Delete(&PublishSetting{})
+	return err
+}
+
+func (s *SqlStorage) ListApiTokens() ([]ApiToken, error) {
+	var tokens []ApiToken
+	err := s.engine.OrderBy("id").Find(&tokens)
+	return tokens, err
+}
+
+func (s *SqlStorage) GetApiTokenByHash(hash string) (ApiToken, error) {
+	var token ApiToken
+	found, err := s.engine.Where("token_hash = ?", hash).Get(&token)
+	if err == nil && !found {
+		err = ErrNotFound
+	}
+	return token, err
+}
+
+func (s *SqlStorage) CreateApiToken(token *ApiToken) error {
+	_, err := s.engine.Insert(token)
+	return err
+}
+
+func (s *SqlStorage) DeleteApiToken(id int64) error {
+	_, err := s.engine.Id(id).Delete(&ApiToken{})
+	return err
+}
+
+func (s *SqlStorage) TouchApiToken(id int64, usedAt time.Time) error {
+	_, err := s.engine.Id(id).Cols("last_used_at").Update(&ApiToken{LastUsedAt: usedAt})
+	return err
+}
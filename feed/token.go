@@ -0,0 +1,211 @@
+package feed
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+// API token scopes, the API routes each require one of them.
+const (
+	scopeRead          = "read"
+	scopeManageSources = "manage-sources"
+	scopeRefresh       = "refresh"
+)
+
+var tokenScopes = []string{scopeRead, scopeManageSources, scopeRefresh}
+
+// tokenPrefix starts every API token, making leaked tokens easy to search for.
+const tokenPrefix = "rjio_"
+
+func newApiToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashApiToken returns the stored form of a token. Tokens are random enough
+// for a plain hash to be safe.
+func hashApiToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// HasScope reports whether the token was granted scope.
+func (t ApiToken) HasScope(scope string) bool {
+	for _, s := range strings.Split(t.Scopes, ",") {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// bearerToken returns the token sent in the Authorization header, if any.
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[7:]), true
+}
+
+// ApiAuthMiddleware lets through requests with a valid API token, whose
+// scopes are then checked by RequireScope, or with the session of the admin,
+// who may use every route.
+func ApiAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value, ok := bearerToken(r)
+		if !ok {
+			if signedIn(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			render.Render(w, r, ErrUnauthorized)
+			return
+		}
+
+		token, err := DbGetApiTokenByHash(hashApiToken(value))
+		if err == ErrNotFound {
+			render.Render(w, r, ErrUnauthorized)
+			return
+		}
+		if err != nil {
+			render.Render(w, r, ErrInternal(err))
+			return
+		}
+
+		token.LastUsedAt = time.Now()
+		err = DbTouchApiToken(token.ID, token.LastUsedAt)
+		if err != nil {
+			log.Printf("cannot update api token, id=%d, err=%v", token.ID, err)
+		}
+
+		ctx := context.WithValue(r.Context(), "apiToken", token)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequireScope rejects requests made with an API token lacking scope.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := r.Context().Value("apiToken").(ApiToken)
+			if ok && !token.HasScope(scope) {
+				render.Render(w, r, ErrForbidden(fmt.Errorf("token lacks the %s scope", scope)))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func ApiTokenCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenID := chi.URLParam(r, "tokenID")
+		tid, err := strconv.ParseInt(tokenID, 10, 64)
+		if err != nil {
+			http.Error(w, http.StatusText(400), 400)
+			return
+		}
+		ctx := context.WithValue(r.Context(), "tokenID", tid)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func listTokensHandler(w http.ResponseWriter, r *http.Request) {
+	renderTokens(w, r, "", r.Context().Value("flash"))
+}
+
+func createTokenHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	name := r.Form.Get("name")
+	if name == "" {
+		w.Write([]byte(fmt.Sprintf("name is required")))
+		return
+	}
+
+	var scopes []string
+	for _, scope := range tokenScopes {
+		for _, s := range r.Form["scope"] {
+			if s == scope {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	if len(scopes) == 0 {
+		w.Write([]byte(fmt.Sprintf("at least one scope is required")))
+		return
+	}
+
+	value, err := newApiToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	token := ApiToken{
+		Name:      name,
+		TokenHash: hashApiToken(value),
+		Prefix:    value[:len(tokenPrefix)+6],
+		Scopes:    strings.Join(scopes, ","),
+		CreatedAt: time.Now(),
+	}
+	err = DbCreateApiToken(&token)
+	if err != nil {
+		log.Printf("cannot create api token, err=%s", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	// the token is shown this once, only its hash is kept
+	renderTokens(w, r, value, fmt.Sprintf("new token added, id=%d", token.ID))
+}
+
+func deleteTokenHandler(w http.ResponseWriter, r *http.Request) {
+	tokenID := r.Context().Value("tokenID").(int64)
+
+	err := DbDeleteApiToken(tokenID)
+	if err != nil {
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+
+	err = saveFlash(w, r, fmt.Sprintf("token id: %d revoked", tokenID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/feeds/tokens", http.StatusSeeOther)
+}
+
+func renderTokens(w http.ResponseWriter, r *http.Request, newToken string, message interface{}) {
+	tokens, err := DbListApiTokens()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = renderTemplate(w, r, "tokens.html", map[string]interface{}{
+		"tokens":   tokens,
+		"scopes":   tokenScopes,
+		"newToken": newToken,
+		"message":  message,
+	})
+	if err != nil {
+		fmt.Printf("\nRender Error: %v\n", err)
+		return
+	}
+}
@@ -52,6 +52,8 @@ func main() {
 	feed.SetupDb(&cfg)
 	fetcher := feed.SetupFetcher(&cfg)
 	fetcher.Start()
+	pruner := feed.SetupPruner(&cfg)
+	pruner.Start()
 	mux := feed.SetupHandler(&cfg)
 
 	fmt.Println("Serving content at port :" + *portPtr)
@@ -0,0 +1,90 @@
+package feedfmt
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/antchfx/xmlquery"
+)
+
+// AtomNamespace is the XML namespace of Atom 1.0 documents.
+const AtomNamespace = "http://www.w3.org/2005/Atom"
+
+// IsAtom reports whether doc is an Atom feed document.
+func IsAtom(doc *xmlquery.Node) bool {
+	for n := doc.FirstChild; n != nil; n = n.NextSibling {
+		if n.Type == xmlquery.ElementNode {
+			return n.Data == "feed" && n.NamespaceURI == AtomNamespace
+		}
+	}
+	return false
+}
+
+// ParseAtomEntry reads an Atom <entry> element. PubDate is left zero when the
+// entry has no date that can be parsed, RawPubDate keeps the original text.
+func ParseAtomEntry(n *xmlquery.Node) (*Entry, error) {
+	idNode := n.SelectElement("id")
+	if idNode == nil {
+		return nil, fmt.Errorf("cannot parse id")
+	}
+
+	entry := Entry{
+		GUID: strings.TrimSpace(idNode.InnerText()),
+		Raw:  n.OutputXML(true),
+	}
+
+	for _, name := range []string{"published", "updated"} {
+		if d := n.SelectElement(name); d != nil {
+			entry.RawPubDate = strings.TrimSpace(d.InnerText())
+			break
+		}
+	}
+	if t, err := ParseDate(entry.RawPubDate); err == nil {
+		entry.PubDate = t
+	}
+
+	if t := n.SelectElement("title"); t != nil {
+		entry.Title = atomText(t)
+	}
+	if s := n.SelectElement("summary"); s != nil {
+		entry.Description = atomText(s)
+	}
+	if c := n.SelectElement("content"); c != nil && c.SelectAttr("src") == "" {
+		entry.Content = atomText(c)
+		if entry.Description == "" {
+			entry.Description = entry.Content
+		}
+	}
+	if a := n.SelectElement("author/name"); a != nil {
+		entry.Author = strings.TrimSpace(a.InnerText())
+	}
+
+	for _, link := range n.SelectElements("link") {
+		href := link.SelectAttr("href")
+		switch link.SelectAttr("rel") {
+		case "", "alternate":
+			if entry.Link == "" {
+				entry.Link = href
+			}
+		case "enclosure":
+			if entry.EnclosureURL == "" {
+				entry.EnclosureURL = href
+				entry.EnclosureType = link.SelectAttr("type")
+				entry.EnclosureLength = link.SelectAttr("length")
+			}
+		}
+	}
+	return &entry, nil
+}
+
+// atomText returns the content of an Atom text construct, keeping the markup
+// of xhtml content.
+func atomText(n *xmlquery.Node) string {
+	if n.SelectAttr("type") != "xhtml" {
+		return strings.TrimSpace(n.InnerText())
+	}
+	if div := n.SelectElement("div"); div != nil {
+		return strings.TrimSpace(div.OutputXML(false))
+	}
+	return strings.TrimSpace(n.OutputXML(false))
+}
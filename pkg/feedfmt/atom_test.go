@@ -0,0 +1,113 @@
+package feedfmt
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/antchfx/xmlquery"
+)
+
+func TestParseAtomEntry(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   string
+		want    Entry
+		wantErr bool
+	}{
+		{
+			name: "full",
+			entry: `<entry>
+				<id>urn:uuid:1</id>
+				<title>Ep 1</title>
+				<published>2023-01-02T03:00:00Z</published>
+				<updated>2023-01-05T03:00:00Z</updated>
+				<summary>short</summary>
+				<content type="html">&lt;p&gt;long&lt;/p&gt;</content>
+				<author><name>Jane</name></author>
+				<link href="http://example.org/1"/>
+				<link rel="enclosure" href="http://example.org/1.mp3" type="audio/mpeg" length="10"/>
+			</entry>`,
+			want: Entry{
+				GUID:            "urn:uuid:1",
+				Title:           "Ep 1",
+				Link:            "http://example.org/1",
+				Description:     "short",
+				Content:         "<p>long</p>",
+				Author:          "Jane",
+				PubDate:         time.Date(2023, 1, 2, 3, 0, 0, 0, time.UTC),
+				RawPubDate:      "2023-01-02T03:00:00Z",
+				EnclosureURL:    "http://example.org/1.mp3",
+				EnclosureType:   "audio/mpeg",
+				EnclosureLength: "10",
+			},
+		},
+		{
+			name: "updated only, content as description",
+			entry: `<entry>
+				<id>urn:uuid:2</id>
+				<updated>2023-01-05T03:00:00Z</updated>
+				<content type="xhtml"><div xmlns="http://www.w3.org/1999/xhtml">hello</div></content>
+			</entry>`,
+			want: Entry{
+				GUID:        "urn:uuid:2",
+				Description: "hello",
+				Content:     "hello",
+				PubDate:     time.Date(2023, 1, 5, 3, 0, 0, 0, time.UTC),
+				RawPubDate:  "2023-01-05T03:00:00Z",
+			},
+		},
+		{
+			name:  "bad date",
+			entry: `<entry><id>urn:uuid:3</id><published>soon</published></entry>`,
+			want:  Entry{GUID: "urn:uuid:3", RawPubDate: "soon"},
+		},
+		{
+			name:    "no id",
+			entry:   `<entry><title>Ep</title></entry>`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		doc, err := xmlquery.Parse(strings.NewReader(`<feed xmlns="` + AtomNamespace + `">` + tt.entry + `</feed>`))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got, err := ParseAtomEntry(xmlquery.FindOne(doc, "//entry"))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: ParseAtomEntry succeeded, want an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: ParseAtomEntry error: %v", tt.name, err)
+			continue
+		}
+		got.Raw = ""
+		if *got != tt.want {
+			t.Errorf("%s: ParseAtomEntry = %+v, want %+v", tt.name, *got, tt.want)
+		}
+	}
+}
+
+func TestIsAtom(t *testing.T) {
+	tests := []struct {
+		doc  string
+		want bool
+	}{
+		{`<feed xmlns="http://www.w3.org/2005/Atom"></feed>`, true},
+		{`<?xml version="1.0"?><feed xmlns="http://www.w3.org/2005/Atom"></feed>`, true},
+		{`<feed></feed>`, false},
+		{`<rss><channel></channel></rss>`, false},
+	}
+	for _, tt := range tests {
+		doc, err := xmlquery.Parse(strings.NewReader(tt.doc))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.doc, err)
+		}
+		if got := IsAtom(doc); got != tt.want {
+			t.Errorf("IsAtom(%s) = %v, want %v", tt.doc, got, tt.want)
+		}
+	}
+}
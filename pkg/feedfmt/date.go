@@ -0,0 +1,167 @@
+package feedfmt
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// buddhistEraOffset is the difference between Thai Buddhist Era and
+// Gregorian years.
+const buddhistEraOffset = 543
+
+// dateLayouts are tried in order after a date has been normalized, i.e. the
+// weekday has been dropped, named zones turned into offsets and Thai month
+// names into English ones.
+var dateLayouts = []string{
+	"2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 -07:00",
+	"2 Jan 2006 15:04 -0700",
+	"2 Jan 2006 15:04 -07:00",
+	"2 Jan 2006 15:04:05",
+	"2 Jan 2006 15:04",
+	"2 Jan 06 15:04:05 -0700",
+	"2 Jan 06 15:04 -0700",
+	"2 Jan 2006",
+	"Jan 2 2006 15:04:05 -0700",
+	"Jan 2 2006 15:04:05",
+	"Jan 2 2006",
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05 -07:00",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"2/1/2006 15:04:05",
+	"2/1/2006 15:04",
+	"2/1/2006",
+}
+
+// zoneOffsets maps the zone abbreviations seen in feeds to their offsets.
+// Go's parser accepts unknown abbreviations but silently treats them as UTC.
+var zoneOffsets = map[string]string{
+	"UT":   "+0000",
+	"UTC":  "+0000",
+	"GMT":  "+0000",
+	"Z":    "+0000",
+	"EST":  "-0500",
+	"EDT":  "-0400",
+	"CST":  "-0600",
+	"CDT":  "-0500",
+	"MST":  "-0700",
+	"MDT":  "-0600",
+	"PST":  "-0800",
+	"PDT":  "-0700",
+	"AKST": "-0900",
+	"AKDT": "-0800",
+	"HST":  "-1000",
+	"BST":  "+0100",
+	"IST":  "+0530",
+	"CET":  "+0100",
+	"CEST": "+0200",
+	"EET":  "+0200",
+	"EEST": "+0300",
+	"MSK":  "+0300",
+	"ICT":  "+0700",
+	"WIB":  "+0700",
+	"SGT":  "+0800",
+	"HKT":  "+0800",
+	"PHT":  "+0800",
+	"AWST": "+0800",
+	"JST":  "+0900",
+	"KST":  "+0900",
+	"ACST": "+0930",
+	"AEST": "+1000",
+	"AEDT": "+1100",
+	"NZST": "+1200",
+	"NZDT": "+1300",
+}
+
+// thaiMonths maps full and abbreviated Thai month names, longest first so
+// that a full name is never partially replaced by its abbreviation.
+var thaiMonths = []struct{ thai, english string }{
+	{"มกราคม", "Jan"}, {"กุมภาพันธ์", "Feb"}, {"มีนาคม", "Mar"},
+	{"เมษายน", "Apr"}, {"พฤษภาคม", "May"}, {"มิถุนายน", "Jun"},
+	{"กรกฎาคม", "Jul"}, {"สิงหาคม", "Aug"}, {"กันยายน", "Sep"},
+	{"ตุลาคม", "Oct"}, {"พฤศจิกายน", "Nov"}, {"ธันวาคม", "Dec"},
+	{"ม.ค.", "Jan"}, {"ก.พ.", "Feb"}, {"มี.ค.", "Mar"},
+	{"เม.ย.", "Apr"}, {"พ.ค.", "May"}, {"มิ.ย.", "Jun"},
+	{"ก.ค.", "Jul"}, {"ส.ค.", "Aug"}, {"ก.ย.", "Sep"},
+	{"ต.ค.", "Oct"}, {"พ.ย.", "Nov"}, {"ธ.ค.", "Dec"},
+}
+
+var (
+	// a leading weekday in English or Thai, full or abbreviated
+	weekdayPattern = regexp.MustCompile(`^(?i:(mon|tue|wed|thu|fri|sat|sun)[a-z]*\.?|(วัน)?(จันทร์|อังคาร|พุธ|พฤหัสบดี|พฤหัส|ศุกร์|เสาร์|อาทิตย์|จ\.|อ\.|พ\.|พฤ\.|ศ\.|ส\.|อา\.)(ที่)?)\s*,?\s*`)
+	// English month names, full or abbreviated, reduced to the abbreviation
+	monthPattern = regexp.MustCompile(`(?i)\b(jan|feb|mar|apr|may|jun|jul|aug|sep|oct|nov|dec)[a-z]*\.?`)
+	// zones written as GMT+7, UTC+07:00 or UTC-0330
+	zoneOffsetPattern = regexp.MustCompile(`(?i)\b(?:GMT|UTC)([+-])(\d{1,2})(?::?(\d{2}))?$`)
+	// Thai feeds sometimes write "น." (hours) after the time and mark the
+	// era before the year
+	thaiHourSuffix = regexp.MustCompile(`\s*น\.`)
+	thaiEraMarker  = regexp.MustCompile(`(พ\.ศ\.|ค\.ศ\.)\s*`)
+	spaces         = regexp.MustCompile(`\s+`)
+)
+
+var thaiDigits = strings.NewReplacer(
+	"๐", "0", "๑", "1", "๒", "2", "๓", "3", "๔", "4",
+	"๕", "5", "๖", "6", "๗", "7", "๘", "8", "๙", "9",
+)
+
+// ParseDate parses the publication dates found in RSS, Atom and JSON feeds.
+// Besides RFC 1123 and RFC 3339 it accepts single digit days, missing
+// seconds, named zones, missing weekdays and Thai month names with Buddhist
+// Era years. Dates without a zone are taken as UTC.
+func ParseDate(value string) (time.Time, error) {
+	normalized := normalizeDate(value)
+	if normalized == "" {
+		return time.Time{}, fmt.Errorf("empty date")
+	}
+
+	for _, layout := range dateLayouts {
+		t, err := time.Parse(layout, normalized)
+		if err != nil {
+			continue
+		}
+		if t.Year() > 2400 {
+			t = t.AddDate(-buddhistEraOffset, 0, 0)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse date %q", value)
+}
+
+func normalizeDate(value string) string {
+	s := thaiDigits.Replace(strings.TrimSpace(value))
+	s = thaiHourSuffix.ReplaceAllString(s, "")
+	s = thaiEraMarker.ReplaceAllString(s, "")
+	s = weekdayPattern.ReplaceAllString(s, "")
+	for _, month := range thaiMonths {
+		s = strings.Replace(s, month.thai, " "+month.english+" ", 1)
+	}
+	s = monthPattern.ReplaceAllString(s, "$1")
+	s = strings.Replace(s, ",", " ", -1)
+	s = strings.TrimSpace(spaces.ReplaceAllString(s, " "))
+
+	if m := zoneOffsetPattern.FindStringSubmatch(s); m != nil {
+		hours, _ := strconv.Atoi(m[2])
+		minutes, _ := strconv.Atoi(m[3])
+		offset := fmt.Sprintf(" %s%02d%02d", m[1], hours, minutes)
+		s = strings.TrimSpace(s[:len(s)-len(m[0])]) + offset
+	}
+
+	if i := strings.LastIndex(s, " "); i >= 0 {
+		if offset, ok := zoneOffsets[strings.ToUpper(s[i+1:])]; ok {
+			s = s[:i+1] + offset
+		}
+	}
+	return s
+}
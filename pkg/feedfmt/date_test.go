@@ -0,0 +1,46 @@
+package feedfmt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDate(t *testing.T) {
+	ict := time.FixedZone("", 7*60*60)
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"Mon, 02 Jan 2023 10:00:00 +0700", time.Date(2023, 1, 2, 10, 0, 0, 0, ict)},
+		{"Mon, 2 Jan 2023 10:00:00 +0700", time.Date(2023, 1, 2, 10, 0, 0, 0, ict)},
+		{"2 Jan 2023 10:00 +0700", time.Date(2023, 1, 2, 10, 0, 0, 0, ict)},
+		{"Monday, 02 January 2023 10:00:00 ICT", time.Date(2023, 1, 2, 10, 0, 0, 0, ict)},
+		{"Mon, 02 Jan 2023 03:00:00 GMT", time.Date(2023, 1, 2, 3, 0, 0, 0, time.UTC)},
+		{"Mon, 02 Jan 2023 10:00:00 GMT+7", time.Date(2023, 1, 2, 10, 0, 0, 0, ict)},
+		{"2023-01-02T10:00:00+07:00", time.Date(2023, 1, 2, 10, 0, 0, 0, ict)},
+		{"2023-01-02T03:00:00Z", time.Date(2023, 1, 2, 3, 0, 0, 0, time.UTC)},
+		{"2023-01-02 03:00:00", time.Date(2023, 1, 2, 3, 0, 0, 0, time.UTC)},
+		{"2023-01-02", time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"2 มกราคม 2566 10:00 น.", time.Date(2023, 1, 2, 10, 0, 0, 0, time.UTC)},
+		{"วันจันทร์ที่ 2 ม.ค. พ.ศ. 2566", time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"๒ ม.ค. ๒๕๖๖", time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := ParseDate(tt.value)
+		if err != nil {
+			t.Errorf("ParseDate(%q) error: %v", tt.value, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("ParseDate(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseDateInvalid(t *testing.T) {
+	for _, value := range []string{"", "  ", "yesterday", "32 Jan 2023", "2023-13-01"} {
+		if got, err := ParseDate(value); err == nil {
+			t.Errorf("ParseDate(%q) = %v, want an error", value, got)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package feedfmt
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/antchfx/xmlquery"
+)
+
+// EnclosureRewriter rewrites the URL of an enclosure, typically to route
+// downloads through a tracking service.
+type EnclosureRewriter interface {
+	RewriteEnclosure(enclosureURL string) (string, error)
+}
+
+// Tracker types.
+const (
+	TrackerPrefix    = "prefix"
+	TrackerPodtrac   = "podtrac"
+	TrackerChartable = "chartable"
+	TrackerOP3       = "op3"
+	TrackerPodsights = "podsights"
+	TrackerUnescape  = "unescape"
+)
+
+// Tracker configures an enclosure rewriter. Prefix is used by the prefix
+// type, ID by chartable and Hosts by unescape.
+type Tracker struct {
+	Type   string   `yaml:"type" json:"type"`
+	Prefix string   `yaml:"prefix" json:"prefix,omitempty"`
+	ID     string   `yaml:"id" json:"id,omitempty"`
+	Hosts  []string `yaml:"hosts" json:"hosts,omitempty"`
+}
+
+// unescapedHosts serve enclosures whose path embeds the escaped URL of the
+// actual file, trackers in front of them need the path unescaped.
+var unescapedHosts = []string{"anchor.fm"}
+
+// PrefixRewriter inserts Prefix, usually a host and path ending with a slash,
+// between the scheme and the rest of the URL, the way prefix-style trackers
+// such as Podtrac expect. URLs without a scheme are left as they are.
+type PrefixRewriter struct {
+	Prefix string
+}
+
+func (p PrefixRewriter) RewriteEnclosure(enclosureURL string) (string, error) {
+	i := strings.Index(enclosureURL, "://")
+	if i <= 0 || p.Prefix == "" {
+		return enclosureURL, nil
+	}
+	rest := enclosureURL[i+3:]
+	if strings.HasPrefix(rest, p.Prefix) {
+		// already tracked, e.g. by the source itself
+		return enclosureURL, nil
+	}
+	return enclosureURL[:i+3] + p.Prefix + rest, nil
+}
+
+// UnescapeRewriter unescapes the path of URLs served from Hosts, or from a
+// subdomain of them.
+type UnescapeRewriter struct {
+	Hosts []string
+}
+
+func (u UnescapeRewriter) RewriteEnclosure(enclosureURL string) (string, error) {
+	parsed, err := url.Parse(enclosureURL)
+	if err != nil || !matchHost(parsed.Hostname(), u.Hosts) {
+		return enclosureURL, nil
+	}
+	unescaped, err := url.PathUnescape(enclosureURL)
+	if err != nil {
+		return "", fmt.Errorf("cannot unescape enclosure %s: %v", enclosureURL, err)
+	}
+	return unescaped, nil
+}
+
+func matchHost(host string, hosts []string) bool {
+	host = strings.ToLower(host)
+	for _, h := range hosts {
+		h = strings.ToLower(h)
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// ChainRewriter applies rewriters in order, each one wrapping the URL
+// produced by the previous one.
+type ChainRewriter []EnclosureRewriter
+
+func (c ChainRewriter) RewriteEnclosure(enclosureURL string) (string, error) {
+	var err error
+	for _, rewriter := range c {
+		enclosureURL, err = rewriter.RewriteEnclosure(enclosureURL)
+		if err != nil {
+			return "", err
+		}
+	}
+	return enclosureURL, nil
+}
+
+// NewTrackerRewriter builds the rewriter of a tracker.
+func NewTrackerRewriter(tracker Tracker) (EnclosureRewriter, error) {
+	switch tracker.Type {
+	case TrackerPrefix:
+		if tracker.Prefix == "" {
+			return nil, fmt.Errorf("prefix tracker needs a prefix")
+		}
+		return PrefixRewriter{Prefix: tracker.Prefix}, nil
+	case TrackerPodtrac:
+		return PrefixRewriter{Prefix: "dts.podtrac.com/redirect.mp3/"}, nil
+	case TrackerChartable:
+		if tracker.ID == "" {
+			return nil, fmt.Errorf("chartable tracker needs an id")
+		}
+		return PrefixRewriter{Prefix: "chtbl.com/track/" + tracker.ID + "/"}, nil
+	case TrackerOP3:
+		return PrefixRewriter{Prefix: "op3.dev/e/"}, nil
+	case TrackerPodsights:
+		return PrefixRewriter{Prefix: "pdst.fm/e/"}, nil
+	case TrackerUnescape:
+		if len(tracker.Hosts) == 0 {
+			return nil, fmt.Errorf("unescape tracker needs hosts")
+		}
+		return UnescapeRewriter{Hosts: tracker.Hosts}, nil
+	}
+	return nil, fmt.Errorf("unknown tracker type %s", tracker.Type)
+}
+
+// NewEnclosureRewriter builds the rewriter of a channel from its legacy
+// tracking prefix and its trackers, applied in that order. Enclosures served
+// by hosts that embed an escaped URL are unescaped first. It returns nil when
+// enclosures are left untouched.
+func NewEnclosureRewriter(prefix string, trackers []Tracker) (EnclosureRewriter, error) {
+	var chain ChainRewriter
+	if prefix != "" {
+		chain = append(chain, PrefixRewriter{Prefix: prefix})
+	}
+	for _, tracker := range trackers {
+		rewriter, err := NewTrackerRewriter(tracker)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, rewriter)
+	}
+	if len(chain) == 0 {
+		return nil, nil
+	}
+	return append(ChainRewriter{UnescapeRewriter{Hosts: unescapedHosts}}, chain...), nil
+}
+
+// trackerPrefixes match the prefixes trackers insert before the host of an
+// enclosure.
+var trackerPrefixes = []*regexp.Regexp{
+	regexp.MustCompile(`^(dts|www)\.podtrac\.com/(pts/)?redirect\.mp3/`),
+	regexp.MustCompile(`^chtbl\.com/track/[^/]+/`),
+	regexp.MustCompile(`^op3\.dev/e/`),
+	regexp.MustCompile(`^pdst\.fm/e/`),
+}
+
+// NormalizeEnclosureURL reduces an enclosure URL to the host and path of the
+// file, without scheme, query and the prefixes of known trackers, so that
+// copies of an episode served through different trackers compare equal.
+func NormalizeEnclosureURL(enclosureURL string) string {
+	s := stripScheme(strings.TrimSpace(enclosureURL))
+	for stripped := true; stripped; {
+		stripped = false
+		for _, prefix := range trackerPrefixes {
+			if loc := prefix.FindStringIndex(strings.ToLower(s)); loc != nil {
+				s = stripScheme(s[loc[1]:])
+				stripped = true
+			}
+		}
+	}
+	if i := strings.IndexAny(s, "?#"); i >= 0 {
+		s = s[:i]
+	}
+	host, path := s, ""
+	if i := strings.Index(s, "/"); i >= 0 {
+		host, path = s[:i], s[i:]
+	}
+	return strings.TrimPrefix(strings.ToLower(host), "www.") + path
+}
+
+func stripScheme(s string) string {
+	if i := strings.Index(s, "://"); i > 0 {
+		return s[i+3:]
+	}
+	return s
+}
+
+// RewriteEnclosures rewrites the url attribute of the enclosures of an item.
+func RewriteEnclosures(item *xmlquery.Node, rewriter EnclosureRewriter) error {
+	for _, enclosure := range item.SelectElements("enclosure") {
+		enclosureURL := enclosure.SelectAttr("url")
+		if enclosureURL == "" {
+			continue
+		}
+		rewritten, err := rewriter.RewriteEnclosure(enclosureURL)
+		if err != nil {
+			return err
+		}
+		SetAttr(enclosure, "url", rewritten)
+	}
+	return nil
+}
+
+// RewriteEntryEnclosures is RewriteEnclosures for a stored item fragment.
+func RewriteEntryEnclosures(entry string, rewriter EnclosureRewriter) (string, error) {
+	item, err := ParseItem(entry)
+	if err != nil {
+		return "", err
+	}
+	if err := RewriteEnclosures(item, rewriter); err != nil {
+		return "", err
+	}
+	return OutputXML(item), nil
+}
@@ -0,0 +1,133 @@
+// Package feedfmt converts between the syndication formats rjio reads and
+// the RSS items it stores and serves.
+package feedfmt
+
+import (
+	"encoding/xml"
+	"mime"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antchfx/xmlquery"
+)
+
+// Entry is a feed item read from a non-RSS source, normalized to the fields
+// rjio needs to store and render it. PubDate is zero when the entry has no
+// date that can be parsed.
+type Entry struct {
+	GUID            string
+	Title           string
+	Link            string
+	Description     string
+	Content         string
+	Author          string
+	PubDate         time.Time
+	RawPubDate      string
+	EnclosureURL    string
+	EnclosureType   string
+	EnclosureLength string
+	Duration        time.Duration
+	// Raw is the entry as it appeared in the source document
+	Raw string
+}
+
+// RSS renders the entry as an RSS 2.0 <item> element so it can be spliced
+// into the combined feed next to items fetched from RSS sources.
+func (e *Entry) RSS() string {
+	var b strings.Builder
+	b.WriteString("<item>")
+	writeElement(&b, "title", e.Title)
+	writeElement(&b, "link", e.Link)
+	b.WriteString(`<guid isPermaLink="false">`)
+	xml.EscapeText(&b, []byte(e.GUID))
+	b.WriteString("</guid>")
+	if !e.PubDate.IsZero() {
+		writeElement(&b, "pubDate", e.PubDate.Format(time.RFC1123Z))
+	}
+	writeElement(&b, "description", e.Description)
+	writeElement(&b, "content:encoded", e.Content)
+	writeElement(&b, "itunes:author", e.Author)
+	if e.Duration > 0 {
+		writeElement(&b, "itunes:duration", strconv.Itoa(int(e.Duration.Seconds())))
+	}
+	if e.EnclosureURL != "" {
+		length := e.EnclosureLength
+		if length == "" {
+			length = "0"
+		}
+		b.WriteString(`<enclosure url="`)
+		xml.EscapeText(&b, []byte(e.EnclosureURL))
+		b.WriteString(`" length="`)
+		xml.EscapeText(&b, []byte(length))
+		b.WriteString(`" type="`)
+		xml.EscapeText(&b, []byte(e.enclosureType()))
+		b.WriteString(`"/>`)
+	}
+	b.WriteString("</item>")
+	return b.String()
+}
+
+func (e *Entry) enclosureType() string {
+	if e.EnclosureType != "" {
+		return e.EnclosureType
+	}
+	if t := mime.TypeByExtension(path.Ext(stripQuery(e.EnclosureURL))); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+func writeElement(b *strings.Builder, name string, value string) {
+	if value == "" {
+		return
+	}
+	b.WriteString("<" + name + ">")
+	xml.EscapeText(b, []byte(value))
+	b.WriteString("</" + name + ">")
+}
+
+func stripQuery(u string) string {
+	if i := strings.IndexAny(u, "?#"); i >= 0 {
+		return u[:i]
+	}
+	return u
+}
+
+// ReadItem reads the fields of an RSS <item> element, the converse of RSS.
+// PubDate is left zero when the item has no date that can be parsed.
+func ReadItem(n *xmlquery.Node) Entry {
+	entry := Entry{
+		GUID:        childText(n, "guid"),
+		Title:       childText(n, "title"),
+		Link:        childText(n, "link"),
+		Description: childText(n, "description"),
+		Content:     childText(n, "content:encoded"),
+		Author:      childText(n, "itunes:author"),
+		RawPubDate:  childText(n, "pubDate"),
+		Raw:         n.OutputXML(true),
+	}
+	if entry.Author == "" {
+		entry.Author = childText(n, "author")
+	}
+	if t, err := ParseDate(entry.RawPubDate); err == nil {
+		entry.PubDate = t
+	}
+	if d, err := ParseDuration(childText(n, "itunes:duration")); err == nil {
+		entry.Duration = d
+	}
+	if enclosure := n.SelectElement("enclosure"); enclosure != nil {
+		entry.EnclosureURL = enclosure.SelectAttr("url")
+		entry.EnclosureType = enclosure.SelectAttr("type")
+		entry.EnclosureLength = enclosure.SelectAttr("length")
+	}
+	return entry
+}
+
+func childText(n *xmlquery.Node, name string) string {
+	if child := n.SelectElement(name); child != nil {
+		return strings.TrimSpace(child.InnerText())
+	}
+	return ""
+}
@@ -0,0 +1,92 @@
+package feedfmt
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Item is the part of a stored item shared by the server and the command
+// line tool: the RSS entry served in the feed, along with the fields read
+// from it to render the other formats.
+type Item struct {
+	GUID         string    `json:"guid"`
+	Title        string    `json:"title"`
+	Description  string    `json:"description"`
+	PubDate      time.Time `json:"pubdate"`
+	Raw          string    `json:"raw"`
+	EnclosureUrl string    `json:"enclosureUrl"`
+	Entry        string    `json:"entry"`
+	// Link, Author, enclosure and duration are read from Entry and used to
+	// render the feed in formats other than RSS
+	Link            string        `json:"link,omitempty"`
+	Author          string        `json:"author,omitempty"`
+	EnclosureType   string        `json:"enclosureType,omitempty"`
+	EnclosureLength int64         `json:"enclosureLength,omitempty"`
+	Duration        time.Duration `json:"duration,omitempty"`
+}
+
+// SetEntryFields copies the fields read from the rendered entry of an item.
+func (item *Item) SetEntryFields(entry Entry) {
+	item.Title = entry.Title
+	item.Description = entry.Description
+	item.Link = entry.Link
+	item.Author = entry.Author
+	item.EnclosureUrl = entry.EnclosureURL
+	item.EnclosureType = entry.EnclosureType
+	item.EnclosureLength, _ = strconv.ParseInt(entry.EnclosureLength, 10, 64)
+	item.Duration = entry.Duration
+}
+
+// FeedEntry returns the item as an entry for rendering the Atom and JSON
+// feeds.
+func (item Item) FeedEntry() Entry {
+	entry := Entry{
+		GUID:          item.GUID,
+		Title:         item.Title,
+		Link:          item.Link,
+		Description:   item.Description,
+		Author:        item.Author,
+		PubDate:       item.PubDate,
+		EnclosureURL:  item.EnclosureUrl,
+		EnclosureType: item.EnclosureType,
+		Duration:      item.Duration,
+	}
+	if item.EnclosureLength > 0 {
+		entry.EnclosureLength = strconv.FormatInt(item.EnclosureLength, 10)
+	}
+	return entry
+}
+
+// RewriteEnclosures rewrites the enclosures of the entry of item and its
+// enclosure URL. The item is left as it is when its entry cannot be
+// rewritten.
+func (item *Item) RewriteEnclosures(rewriter EnclosureRewriter) error {
+	entry, err := RewriteEntryEnclosures(item.Entry, rewriter)
+	if err != nil {
+		return fmt.Errorf("cannot rewrite enclosure of item %s: %v", item.GUID, err)
+	}
+	enclosureURL := item.EnclosureUrl
+	if enclosureURL != "" {
+		enclosureURL, err = rewriter.RewriteEnclosure(enclosureURL)
+		if err != nil {
+			return fmt.Errorf("cannot rewrite enclosure of item %s: %v", item.GUID, err)
+		}
+	}
+	item.Entry, item.EnclosureUrl = entry, enclosureURL
+	return nil
+}
+
+// ApplyEnclosureRewriter rewrites the enclosures of items, leaving them as
+// they are when rewriter is nil. It returns the error met for each item, in
+// the order of items, items that cannot be rewritten are left as they are.
+func ApplyEnclosureRewriter(items []*Item, rewriter EnclosureRewriter) []error {
+	errs := make([]error, len(items))
+	if rewriter == nil {
+		return errs
+	}
+	for i, item := range items {
+		errs[i] = item.RewriteEnclosures(rewriter)
+	}
+	return errs
+}
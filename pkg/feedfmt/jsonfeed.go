@@ -0,0 +1,151 @@
+package feedfmt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JSONFeedMediaType is the media type of JSON Feed documents.
+const JSONFeedMediaType = "application/feed+json"
+
+const jsonFeedVersionPrefix = "https://jsonfeed.org/version/"
+
+type jsonFeed struct {
+	Version string            `json:"version"`
+	Items   []json.RawMessage `json:"items"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+}
+
+type jsonFeedAttachment struct {
+	URL               string  `json:"url"`
+	MimeType          string  `json:"mime_type"`
+	SizeInBytes       int64   `json:"size_in_bytes"`
+	DurationInSeconds float64 `json:"duration_in_seconds"`
+}
+
+type jsonFeedItem struct {
+	ID            json.RawMessage      `json:"id"`
+	URL           string               `json:"url"`
+	ExternalURL   string               `json:"external_url"`
+	Title         string               `json:"title"`
+	ContentHTML   string               `json:"content_html"`
+	ContentText   string               `json:"content_text"`
+	Summary       string               `json:"summary"`
+	DatePublished string               `json:"date_published"`
+	DateModified  string               `json:"date_modified"`
+	Author        *jsonFeedAuthor      `json:"author"`
+	Authors       []jsonFeedAuthor     `json:"authors"`
+	Attachments   []jsonFeedAttachment `json:"attachments"`
+}
+
+// IsJSONFeed reports whether a response with the given content type and
+// body should be read as a JSON Feed rather than XML. The body wins over a
+// mislabelled content type.
+func IsJSONFeed(contentType string, body []byte) bool {
+	trimmed := bytes.TrimSpace(bytes.TrimPrefix(body, []byte("\xef\xbb\xbf")))
+	if bytes.HasPrefix(trimmed, []byte("<")) {
+		return false
+	}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		switch mediaType {
+		case JSONFeedMediaType, "application/json":
+			return true
+		}
+	}
+	return bytes.HasPrefix(trimmed, []byte("{"))
+}
+
+// ParseJSONFeed reads the items of a JSON Feed 1.0 or 1.1 document. Items
+// without an id or that cannot be read are skipped, the latter are reported
+// in warnings.
+func ParseJSONFeed(body []byte) ([]Entry, []string, error) {
+	var feed jsonFeed
+	if err := json.Unmarshal(body, &feed); err != nil {
+		return nil, nil, err
+	}
+	if !strings.HasPrefix(feed.Version, jsonFeedVersionPrefix) {
+		return nil, nil, fmt.Errorf("unsupported json feed version %q", feed.Version)
+	}
+
+	entries := make([]Entry, 0, len(feed.Items))
+	var warnings []string
+	for i, raw := range feed.Items {
+		var it jsonFeedItem
+		if err := json.Unmarshal(raw, &it); err != nil {
+			warnings = append(warnings, fmt.Sprintf("skipped item #%d: %v", i, err))
+			continue
+		}
+		guid := jsonFeedID(it.ID)
+		if guid == "" {
+			continue
+		}
+
+		entry := Entry{
+			GUID:    guid,
+			Title:   it.Title,
+			Link:    it.URL,
+			Content: it.ContentHTML,
+			Raw:     string(raw),
+		}
+		if entry.Link == "" {
+			entry.Link = it.ExternalURL
+		}
+
+		switch {
+		case it.Summary != "":
+			entry.Description = it.Summary
+		case it.ContentText != "":
+			entry.Description = it.ContentText
+		default:
+			entry.Description = it.ContentHTML
+		}
+
+		entry.RawPubDate = it.DatePublished
+		if entry.RawPubDate == "" {
+			entry.RawPubDate = it.DateModified
+		}
+		if t, err := ParseDate(entry.RawPubDate); err == nil {
+			entry.PubDate = t
+		}
+
+		if len(it.Authors) > 0 {
+			entry.Author = it.Authors[0].Name
+		} else if it.Author != nil {
+			entry.Author = it.Author.Name
+		}
+
+		if len(it.Attachments) > 0 {
+			attachment := it.Attachments[0]
+			entry.EnclosureURL = attachment.URL
+			entry.EnclosureType = attachment.MimeType
+			if attachment.SizeInBytes > 0 {
+				entry.EnclosureLength = strconv.FormatInt(attachment.SizeInBytes, 10)
+			}
+			entry.Duration = time.Duration(attachment.DurationInSeconds * float64(time.Second))
+		}
+		entries = append(entries, entry)
+	}
+	return entries, warnings, nil
+}
+
+// jsonFeedID accepts string ids as the spec requires, and the numeric ids
+// some generators emit.
+func jsonFeedID(raw json.RawMessage) string {
+	var id string
+	if err := json.Unmarshal(raw, &id); err == nil {
+		return id
+	}
+	var number json.Number
+	if err := json.Unmarshal(raw, &number); err == nil {
+		return number.String()
+	}
+	return ""
+}
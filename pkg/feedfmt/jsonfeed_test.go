@@ -0,0 +1,93 @@
+package feedfmt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseJSONFeed(t *testing.T) {
+	body := `{
+		"version": "https://jsonfeed.org/version/1.1",
+		"items": [
+			{
+				"id": "1",
+				"url": "http://example.org/1",
+				"title": "Ep 1",
+				"summary": "short",
+				"content_html": "<p>long</p>",
+				"date_published": "2023-01-02T03:00:00Z",
+				"authors": [{"name": "Jane"}],
+				"attachments": [{"url": "http://example.org/1.mp3", "mime_type": "audio/mpeg", "size_in_bytes": 10, "duration_in_seconds": 90}]
+			},
+			{"id": 2, "external_url": "http://example.org/2", "content_text": "text", "date_modified": "later", "author": {"name": "Joe"}},
+			{"title": "no id"},
+			{"id": "4", "title": 4},
+			{"id": "5", "content_html": "html"}
+		]
+	}`
+	entries, warnings, err := ParseJSONFeed([]byte(body))
+	if err != nil {
+		t.Fatalf("ParseJSONFeed error: %v", err)
+	}
+	want := []Entry{
+		{
+			GUID:            "1",
+			Title:           "Ep 1",
+			Link:            "http://example.org/1",
+			Description:     "short",
+			Content:         "<p>long</p>",
+			Author:          "Jane",
+			PubDate:         time.Date(2023, 1, 2, 3, 0, 0, 0, time.UTC),
+			RawPubDate:      "2023-01-02T03:00:00Z",
+			EnclosureURL:    "http://example.org/1.mp3",
+			EnclosureType:   "audio/mpeg",
+			EnclosureLength: "10",
+			Duration:        90 * time.Second,
+		},
+		{GUID: "2", Link: "http://example.org/2", Description: "text", Author: "Joe", RawPubDate: "later"},
+		{GUID: "5", Description: "html", Content: "html"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("ParseJSONFeed returned %d entries, want %d", len(entries), len(want))
+	}
+	for i := range want {
+		entries[i].Raw = ""
+		if entries[i] != want[i] {
+			t.Errorf("entry #%d = %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+	if len(warnings) != 1 {
+		t.Errorf("ParseJSONFeed warnings = %v, want one for the malformed item", warnings)
+	}
+}
+
+func TestParseJSONFeedInvalid(t *testing.T) {
+	for _, body := range []string{
+		`not json`,
+		`{"version": "https://example.org/version/1", "items": []}`,
+		`{"items": []}`,
+	} {
+		if _, _, err := ParseJSONFeed([]byte(body)); err == nil {
+			t.Errorf("ParseJSONFeed(%s) succeeded, want an error", body)
+		}
+	}
+}
+
+func TestIsJSONFeed(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		want        bool
+	}{
+		{"application/feed+json", `{}`, true},
+		{"application/json; charset=utf-8", `{}`, true},
+		{"text/plain", ` {"version": ""}`, true},
+		{"application/json", `<rss/>`, false},
+		{"application/rss+xml", "\xef\xbb\xbf<rss/>", false},
+	}
+	for _, tt := range tests {
+		if got := IsJSONFeed(tt.contentType, []byte(tt.body)); got != tt.want {
+			t.Errorf("IsJSONFeed(%q, %q) = %v, want %v", tt.contentType, tt.body, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package feedfmt
+
+import (
+	"encoding/xml"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/antchfx/xmlquery"
+)
+
+// knownNamespaces are the prefixes declared by the combined feed template.
+var knownNamespaces = map[string]string{
+	"content":    "http://purl.org/rss/1.0/modules/content/",
+	"wfw":        "http://wellformedweb.org/CommentAPI/",
+	"dc":         "http://purl.org/dc/elements/1.1/",
+	"atom":       "http://www.w3.org/2005/Atom",
+	"sy":         "http://purl.org/rss/1.0/modules/syndication/",
+	"slash":      "http://purl.org/rss/1.0/modules/slash/",
+	"itunes":     "http://www.itunes.com/dtds/podcast-1.0.dtd",
+	"googleplay": "http://www.google.com/schemas/play-podcasts/1.0",
+	"spotify":    "http://www.spotify.com/ns/rss",
+}
+
+var prefixPattern = regexp.MustCompile(`[<\s]/?([A-Za-z_][\w.-]*):[A-Za-z_]`)
+
+// ParseItem parses a stored RSS <item> fragment. Stored items lose the
+// namespace declarations of their source document, so every prefix they use
+// is declared on a wrapper element first.
+func ParseItem(entry string) (*xmlquery.Node, error) {
+	prefixes := map[string]bool{}
+	for _, m := range prefixPattern.FindAllStringSubmatch(entry, -1) {
+		if m[1] != "xml" && m[1] != "xmlns" {
+			prefixes[m[1]] = true
+		}
+	}
+	names := make([]string, 0, len(prefixes))
+	for prefix := range prefixes {
+		names = append(names, prefix)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("<rjio")
+	for _, prefix := range names {
+		uri, ok := knownNamespaces[prefix]
+		if !ok {
+			uri = "urn:rjio:ns:" + prefix
+		}
+		fmt.Fprintf(&b, ` xmlns:%s="%s"`, prefix, uri)
+	}
+	b.WriteString(">")
+	b.WriteString(entry)
+	b.WriteString("</rjio>")
+
+	doc, err := xmlquery.Parse(strings.NewReader(b.String()))
+	if err != nil {
+		return nil, err
+	}
+	item := xmlquery.FindOne(doc, "/rjio/item")
+	if item == nil {
+		return nil, fmt.Errorf("entry has no item element")
+	}
+	return item, nil
+}
+
+// OutputXML serializes a node like xmlquery's OutputXML, but escapes
+// attribute values and keeps text as it is.
+func OutputXML(n *xmlquery.Node) string {
+	var b strings.Builder
+	outputXML(&b, n)
+	return b.String()
+}
+
+func outputXML(b *strings.Builder, n *xmlquery.Node) {
+	switch n.Type {
+	case xmlquery.TextNode:
+		xml.EscapeText(b, []byte(n.Data))
+		return
+	case xmlquery.CommentNode:
+		b.WriteString("<!--" + n.Data + "-->")
+		return
+	case xmlquery.DocumentNode:
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			outputXML(b, child)
+		}
+		return
+	case xmlquery.ElementNode:
+	default:
+		return
+	}
+
+	name := qualifiedName(n.Prefix, n.Data)
+	b.WriteString("<" + name)
+	for _, attr := range n.Attr {
+		b.WriteString(" " + qualifiedName(attr.Name.Space, attr.Name.Local) + `="`)
+		xml.EscapeText(b, []byte(attr.Value))
+		b.WriteString(`"`)
+	}
+	if n.FirstChild == nil {
+		b.WriteString("/>")
+		return
+	}
+	b.WriteString(">")
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		outputXML(b, child)
+	}
+	b.WriteString("</" + name + ">")
+}
+
+func qualifiedName(prefix string, local string) string {
+	if prefix == "" {
+		return local
+	}
+	return prefix + ":" + local
+}
+
+func splitName(name string) (string, string) {
+	if i := strings.Index(name, ":"); i > 0 {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
+
+// SetText replaces the children of an element with a single text node.
+func SetText(n *xmlquery.Node, text string) {
+	child := &xmlquery.Node{
+		Type:   xmlquery.TextNode,
+		Data:   text,
+		Parent: n,
+	}
+	n.FirstChild = child
+	n.LastChild = child
+}
+
+// SetChildText sets the text of the first child element of n with the given
+// name, adding the element when missing. The name may carry a namespace
+// prefix.
+func SetChildText(n *xmlquery.Node, name string, text string) {
+	child := n.SelectElement(name)
+	if child == nil {
+		prefix, local := splitName(name)
+		child = &xmlquery.Node{
+			Type:   xmlquery.ElementNode,
+			Data:   local,
+			Prefix: prefix,
+			Parent: n,
+		}
+		if n.LastChild != nil {
+			n.LastChild.NextSibling = child
+			child.PrevSibling = n.LastChild
+		} else {
+			n.FirstChild = child
+		}
+		n.LastChild = child
+	}
+	SetText(child, text)
+}
+
+// SetAttr sets an attribute of an element, adding it when missing. The name
+// may carry a namespace prefix.
+func SetAttr(n *xmlquery.Node, name string, value string) {
+	space, local := splitName(name)
+	for i, attr := range n.Attr {
+		if attr.Name.Space == space && attr.Name.Local == local {
+			n.Attr[i].Value = value
+			return
+		}
+	}
+	n.Attr = append(n.Attr, xml.Attr{Name: xml.Name{Space: space, Local: local}, Value: value})
+}
+
+// RemoveNode unlinks a node from its parent and siblings.
+func RemoveNode(n *xmlquery.Node) {
+	if n.PrevSibling != nil {
+		n.PrevSibling.NextSibling = n.NextSibling
+	} else if n.Parent != nil {
+		n.Parent.FirstChild = n.NextSibling
+	}
+	if n.NextSibling != nil {
+		n.NextSibling.PrevSibling = n.PrevSibling
+	} else if n.Parent != nil {
+		n.Parent.LastChild = n.PrevSibling
+	}
+	n.Parent, n.PrevSibling, n.NextSibling = nil, nil, nil
+}
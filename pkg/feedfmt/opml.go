@@ -0,0 +1,115 @@
+package feedfmt
+
+import (
+	"encoding/xml"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Outline is an OPML outline. Outlines with an XMLURL are feed
+// subscriptions, others group their child outlines.
+type Outline struct {
+	Text     string    `xml:"text,attr"`
+	Title    string    `xml:"title,attr,omitempty"`
+	Type     string    `xml:"type,attr,omitempty"`
+	XMLURL   string    `xml:"xmlUrl,attr,omitempty"`
+	HTMLURL  string    `xml:"htmlUrl,attr,omitempty"`
+	Outlines []Outline `xml:"outline"`
+}
+
+// Name returns the title of the outline, falling back to its text.
+func (o Outline) Name() string {
+	if o.Title != "" {
+		return strings.TrimSpace(o.Title)
+	}
+	return strings.TrimSpace(o.Text)
+}
+
+type opmlDocument struct {
+	XMLName xml.Name `xml:"opml"`
+	Version string   `xml:"version,attr"`
+	Head    struct {
+		Title       string `xml:"title,omitempty"`
+		DateCreated string `xml:"dateCreated,omitempty"`
+	} `xml:"head"`
+	Body struct {
+		Outlines []Outline `xml:"outline"`
+	} `xml:"body"`
+}
+
+// ReadOPML returns the feed subscriptions of an OPML document, flattening
+// nested outlines.
+func ReadOPML(r io.Reader) ([]Outline, error) {
+	var doc opmlDocument
+	err := xml.NewDecoder(r).Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+	return flattenOutlines(doc.Body.Outlines), nil
+}
+
+func flattenOutlines(outlines []Outline) []Outline {
+	var feeds []Outline
+	for _, o := range outlines {
+		if o.XMLURL != "" {
+			feed := o
+			feed.Outlines = nil
+			feeds = append(feeds, feed)
+		}
+		feeds = append(feeds, flattenOutlines(o.Outlines)...)
+	}
+	return feeds
+}
+
+// WriteOPML writes outlines as an OPML 2.0 document.
+func WriteOPML(w io.Writer, title string, outlines []Outline) error {
+	doc := opmlDocument{Version: "2.0"}
+	doc.Head.Title = title
+	doc.Head.DateCreated = time.Now().Format(time.RFC1123Z)
+	doc.Body.Outlines = outlines
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	return encoder.Encode(doc)
+}
+
+// Slugify derives a slug from the name of a feed, using the host of its URL
+// when the name has no usable characters.
+func Slugify(name string, feedURL string) string {
+	slug := slugText(name)
+	if slug == "" {
+		if u, err := url.Parse(feedURL); err == nil {
+			slug = slugText(u.Hostname())
+		}
+	}
+	if slug == "" {
+		slug = "feed"
+	}
+	return slug
+}
+
+func slugText(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, c := range strings.ToLower(s) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(c)
+			dash = false
+			continue
+		}
+		dash = true
+	}
+	slug := b.String()
+	if len(slug) > 60 {
+		slug = strings.TrimRight(slug[:60], "-")
+	}
+	return slug
+}
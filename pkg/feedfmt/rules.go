@@ -0,0 +1,166 @@
+package feedfmt
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/antchfx/xmlquery"
+	"github.com/antchfx/xpath"
+)
+
+// Rule actions.
+const (
+	ActionRemove = "remove"
+	ActionRename = "rename"
+	ActionText   = "text"
+	ActionAttr   = "attr"
+)
+
+// Rule rewrites the elements of an item matched by an XPath selector.
+//
+// Value is a text/template executed with .Text, the current text of the
+// element or attribute, and .Source, the source the item was fetched from.
+// When Pattern is set, only the parts of the current text matching it are
+// replaced, and Value may refer to capture groups as $1.
+type Rule struct {
+	Select  string `yaml:"select" json:"select"`
+	Action  string `yaml:"action" json:"action"`
+	Name    string `yaml:"name" json:"name,omitempty"`
+	Pattern string `yaml:"pattern" json:"pattern,omitempty"`
+	Value   string `yaml:"value" json:"value,omitempty"`
+}
+
+// DefaultRules are used when no rules are configured. They keep the output
+// of feeds configured before rules existed unchanged.
+var DefaultRules = []Rule{
+	{Select: "itunes:season", Action: ActionRemove},
+}
+
+type compiledRule struct {
+	Rule
+	selector *xpath.Expr
+	pattern  *regexp.Regexp
+	value    *template.Template
+}
+
+// Rewriter applies a list of rules, in order, to items.
+type Rewriter struct {
+	rules []compiledRule
+}
+
+// NewRewriter validates and compiles rules.
+func NewRewriter(rules []Rule) (*Rewriter, error) {
+	rewriter := &Rewriter{}
+	for i, rule := range rules {
+		compiled, err := compileRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule #%d (%s %s): %v", i+1, rule.Action, rule.Select, err)
+		}
+		rewriter.rules = append(rewriter.rules, compiled)
+	}
+	return rewriter, nil
+}
+
+func compileRule(rule Rule) (compiledRule, error) {
+	compiled := compiledRule{Rule: rule}
+
+	selector, err := xpath.Compile(rule.Select)
+	if err != nil {
+		return compiled, err
+	}
+	compiled.selector = selector
+
+	switch rule.Action {
+	case ActionRemove:
+		return compiled, nil
+	case ActionRename, ActionAttr:
+		if rule.Name == "" {
+			return compiled, fmt.Errorf("name is required")
+		}
+	case ActionText:
+	default:
+		return compiled, fmt.Errorf("unknown action")
+	}
+	if rule.Action == ActionRename {
+		return compiled, nil
+	}
+
+	if rule.Pattern != "" {
+		if compiled.pattern, err = regexp.Compile(rule.Pattern); err != nil {
+			return compiled, err
+		}
+	}
+	if compiled.value, err = template.New(rule.Select).Parse(rule.Value); err != nil {
+		return compiled, err
+	}
+	return compiled, nil
+}
+
+// Apply rewrites item in place. source is made available to value templates.
+func (r *Rewriter) Apply(item *xmlquery.Node, source interface{}) error {
+	for _, rule := range r.rules {
+		for _, n := range xmlquery.QuerySelectorAll(item, rule.selector) {
+			if n.Type != xmlquery.ElementNode {
+				continue
+			}
+			if err := rule.apply(n, source); err != nil {
+				return fmt.Errorf("rule %s %s: %v", rule.Action, rule.Select, err)
+			}
+		}
+	}
+	return nil
+}
+
+// ApplyString rewrites a stored RSS item.
+func (r *Rewriter) ApplyString(entry string, source interface{}) (string, error) {
+	if len(r.rules) == 0 {
+		return entry, nil
+	}
+	item, err := ParseItem(entry)
+	if err != nil {
+		return "", err
+	}
+	if err := r.Apply(item, source); err != nil {
+		return "", err
+	}
+	return OutputXML(item), nil
+}
+
+func (rule compiledRule) apply(n *xmlquery.Node, source interface{}) error {
+	switch rule.Action {
+	case ActionRemove:
+		RemoveNode(n)
+	case ActionRename:
+		n.Prefix, n.Data = splitName(rule.Name)
+	case ActionText:
+		text, err := rule.rewrite(n.InnerText(), source)
+		if err != nil {
+			return err
+		}
+		SetText(n, text)
+	case ActionAttr:
+		text, err := rule.rewrite(n.SelectAttr(rule.Name), source)
+		if err != nil {
+			return err
+		}
+		SetAttr(n, rule.Name, text)
+	}
+	return nil
+}
+
+func (rule compiledRule) rewrite(text string, source interface{}) (string, error) {
+	var b strings.Builder
+	err := rule.value.Execute(&b, map[string]interface{}{
+		"Text":   text,
+		"Source": source,
+	})
+	if err != nil {
+		return "", err
+	}
+	if rule.pattern != nil {
+		return rule.pattern.ReplaceAllString(text, b.String()), nil
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,94 @@
+package feedfmt
+
+import (
+	"testing"
+)
+
+func TestRewriterApplyString(t *testing.T) {
+	source := struct{ Name string }{"Show"}
+	tests := []struct {
+		name  string
+		rules []Rule
+		entry string
+		want  string
+	}{
+		{
+			name:  "no rules",
+			entry: `<item><title>Ep 1</title></item>`,
+			want:  `<item><title>Ep 1</title></item>`,
+		},
+		{
+			name:  "remove",
+			rules: []Rule{{Select: "itunes:season", Action: ActionRemove}},
+			entry: `<item><title>Ep 1</title><itunes:season>2</itunes:season></item>`,
+			want:  `<item><title>Ep 1</title></item>`,
+		},
+		{
+			name:  "rename",
+			rules: []Rule{{Select: "itunes:subtitle", Action: ActionRename, Name: "itunes:summary"}},
+			entry: `<item><itunes:subtitle>sub</itunes:subtitle></item>`,
+			want:  `<item><itunes:summary>sub</itunes:summary></item>`,
+		},
+		{
+			name:  "text template",
+			rules: []Rule{{Select: "title", Action: ActionText, Value: "{{ .Source.Name }}: {{ .Text }}"}},
+			entry: `<item><title>Ep 1</title></item>`,
+			want:  `<item><title>Show: Ep 1</title></item>`,
+		},
+		{
+			name:  "text pattern",
+			rules: []Rule{{Select: "title", Action: ActionText, Pattern: `Ep (\d+)`, Value: "Episode $1"}},
+			entry: `<item><title>Ep 1 &amp; more</title></item>`,
+			want:  `<item><title>Episode 1 &amp; more</title></item>`,
+		},
+		{
+			name:  "attr",
+			rules: []Rule{{Select: "enclosure", Action: ActionAttr, Name: "type", Value: "audio/mpeg"}},
+			entry: `<item><enclosure url="http://a/b.mp3?x=1&amp;y=2" type="audio/x"/></item>`,
+			want:  `<item><enclosure url="http://a/b.mp3?x=1&amp;y=2" type="audio/mpeg"/></item>`,
+		},
+		{
+			name: "in order",
+			rules: []Rule{
+				{Select: "title", Action: ActionText, Value: "a"},
+				{Select: "title", Action: ActionText, Value: "{{ .Text }}b"},
+			},
+			entry: `<item><title>x</title></item>`,
+			want:  `<item><title>ab</title></item>`,
+		},
+	}
+	for _, tt := range tests {
+		rewriter, err := NewRewriter(tt.rules)
+		if err != nil {
+			t.Errorf("%s: NewRewriter error: %v", tt.name, err)
+			continue
+		}
+		got, err := rewriter.ApplyString(tt.entry, source)
+		if err != nil {
+			t.Errorf("%s: ApplyString error: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: ApplyString = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNewRewriterInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+	}{
+		{"bad selector", Rule{Select: "title[", Action: ActionRemove}},
+		{"unknown action", Rule{Select: "title", Action: "upcase"}},
+		{"rename without name", Rule{Select: "title", Action: ActionRename}},
+		{"attr without name", Rule{Select: "title", Action: ActionAttr}},
+		{"bad pattern", Rule{Select: "title", Action: ActionText, Pattern: "("}},
+		{"bad template", Rule{Select: "title", Action: ActionText, Value: "{{ .Text"}},
+	}
+	for _, tt := range tests {
+		if _, err := NewRewriter([]Rule{tt.rule}); err == nil {
+			t.Errorf("%s: NewRewriter succeeded, want an error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package feedfmt
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// FeedInfo describes the channel a list of entries is published as.
+type FeedInfo struct {
+	Title       string `yaml:"title"`
+	Description string `yaml:"description"`
+	// Link is the home page of the channel, FeedLink the URL the feed
+	// itself is served from
+	Link     string `yaml:"link"`
+	FeedLink string `yaml:"feedlink"`
+	Author   string `yaml:"author"`
+	Email    string `yaml:"email"`
+	Language string `yaml:"language"`
+	CoverURL string `yaml:"cover-url"`
+}
+
+type atomFeed struct {
+	XMLName   xml.Name      `xml:"feed"`
+	Xmlns     string        `xml:"xmlns,attr"`
+	Lang      string        `xml:"xml:lang,attr,omitempty"`
+	ID        string        `xml:"id"`
+	Title     string        `xml:"title"`
+	Subtitle  string        `xml:"subtitle,omitempty"`
+	Updated   string        `xml:"updated"`
+	Links     []atomLink    `xml:"link"`
+	Author    *atomPerson   `xml:"author,omitempty"`
+	Logo      string        `xml:"logo,omitempty"`
+	Generator atomGenerator `xml:"generator"`
+	Entries   []atomEntry   `xml:"entry"`
+}
+
+type atomGenerator struct {
+	Name string `xml:",chardata"`
+}
+
+type atomLink struct {
+	Rel    string `xml:"rel,attr,omitempty"`
+	Href   string `xml:"href,attr"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length string `xml:"length,attr,omitempty"`
+}
+
+type atomPerson struct {
+	Name  string `xml:"name"`
+	Email string `xml:"email,omitempty"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	ID        string       `xml:"id"`
+	Title     string       `xml:"title"`
+	Published string       `xml:"published,omitempty"`
+	Updated   string       `xml:"updated"`
+	Links     []atomLink   `xml:"link"`
+	Author    *atomPerson  `xml:"author,omitempty"`
+	Summary   *atomContent `xml:"summary,omitempty"`
+	Content   *atomContent `xml:"content,omitempty"`
+}
+
+// WriteAtom writes entries as an Atom 1.0 feed. Enclosures become links with
+// the enclosure relation.
+func WriteAtom(w io.Writer, info FeedInfo, entries []Entry) error {
+	feed := atomFeed{
+		Xmlns:     AtomNamespace,
+		Lang:      info.Language,
+		ID:        atomID(info.FeedLink, info.Link),
+		Title:     info.Title,
+		Subtitle:  info.Description,
+		Updated:   latest(entries).Format(time.RFC3339),
+		Logo:      info.CoverURL,
+		Generator: atomGenerator{Name: "rjio"},
+	}
+	if info.Link != "" {
+		feed.Links = append(feed.Links, atomLink{Rel: "alternate", Href: info.Link})
+	}
+	if info.FeedLink != "" {
+		feed.Links = append(feed.Links, atomLink{Rel: "self", Href: info.FeedLink, Type: "application/atom+xml"})
+	}
+	if info.Author != "" {
+		feed.Author = &atomPerson{Name: info.Author, Email: info.Email}
+	}
+
+	for _, e := range entries {
+		entry := atomEntry{
+			ID:    atomID(e.GUID, e.Link),
+			Title: e.Title,
+		}
+		if !e.PubDate.IsZero() {
+			entry.Published = e.PubDate.Format(time.RFC3339)
+			entry.Updated = entry.Published
+		} else {
+			entry.Updated = feed.Updated
+		}
+		if e.Link != "" {
+			entry.Links = append(entry.Links, atomLink{Rel: "alternate", Href: e.Link})
+		}
+		if e.EnclosureURL != "" {
+			entry.Links = append(entry.Links, atomLink{
+				Rel:    "enclosure",
+				Href:   e.EnclosureURL,
+				Type:   e.enclosureType(),
+				Length: e.EnclosureLength,
+			})
+		}
+		if e.Author != "" {
+			entry.Author = &atomPerson{Name: e.Author}
+		}
+		if e.Description != "" {
+			entry.Summary = &atomContent{Type: "html", Body: e.Description}
+		}
+		if e.Content != "" {
+			entry.Content = &atomContent{Type: "html", Body: e.Content}
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	return encoder.Encode(feed)
+}
+
+// atomID returns the first of ids that is an absolute URI, Atom ids must be
+// IRIs while RSS guids can be any string.
+func atomID(ids ...string) string {
+	for _, id := range ids {
+		if u, err := url.Parse(id); err == nil && u.IsAbs() {
+			return id
+		}
+	}
+	for _, id := range ids {
+		if id != "" {
+			return "urn:rjio:" + url.PathEscape(id)
+		}
+	}
+	return "urn:rjio:feed"
+}
+
+func latest(entries []Entry) time.Time {
+	var t time.Time
+	for _, e := range entries {
+		if e.PubDate.After(t) {
+			t = e.PubDate
+		}
+	}
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return t
+}
+
+type jsonFeedOutput struct {
+	Version     string               `json:"version"`
+	Title       string               `json:"title"`
+	HomePageURL string               `json:"home_page_url,omitempty"`
+	FeedURL     string               `json:"feed_url,omitempty"`
+	Description string               `json:"description,omitempty"`
+	Icon        string               `json:"icon,omitempty"`
+	Language    string               `json:"language,omitempty"`
+	Authors     []jsonFeedAuthor     `json:"authors,omitempty"`
+	Items       []jsonFeedItemOutput `json:"items"`
+}
+
+type jsonFeedItemOutput struct {
+	ID            string                     `json:"id"`
+	URL           string                     `json:"url,omitempty"`
+	Title         string                     `json:"title,omitempty"`
+	ContentHTML   string                     `json:"content_html"`
+	Summary       string                     `json:"summary,omitempty"`
+	DatePublished string                     `json:"date_published,omitempty"`
+	Authors       []jsonFeedAuthor           `json:"authors,omitempty"`
+	Attachments   []jsonFeedAttachmentOutput `json:"attachments,omitempty"`
+}
+
+type jsonFeedAttachmentOutput struct {
+	URL               string `json:"url"`
+	MimeType          string `json:"mime_type"`
+	SizeInBytes       int64  `json:"size_in_bytes,omitempty"`
+	DurationInSeconds int64  `json:"duration_in_seconds,omitempty"`
+}
+
+// WriteJSONFeed writes entries as a JSON Feed 1.1 document. Enclosures become
+// attachments.
+func WriteJSONFeed(w io.Writer, info FeedInfo, entries []Entry) error {
+	feed := jsonFeedOutput{
+		Version:     jsonFeedVersionPrefix + "1.1",
+		Title:       info.Title,
+		HomePageURL: info.Link,
+		FeedURL:     info.FeedLink,
+		Description: info.Description,
+		Icon:        info.CoverURL,
+		Language:    info.Language,
+		Items:       make([]jsonFeedItemOutput, 0, len(entries)),
+	}
+	if info.Author != "" {
+		feed.Authors = []jsonFeedAuthor{{Name: info.Author}}
+	}
+
+	for _, e := range entries {
+		item := jsonFeedItemOutput{
+			ID:          e.GUID,
+			URL:         e.Link,
+			Title:       e.Title,
+			ContentHTML: e.Content,
+		}
+		if item.ContentHTML == "" {
+			item.ContentHTML = e.Description
+		} else {
+			item.Summary = e.Description
+		}
+		if !e.PubDate.IsZero() {
+			item.DatePublished = e.PubDate.Format(time.RFC3339)
+		}
+		if e.Author != "" {
+			item.Authors = []jsonFeedAuthor{{Name: e.Author}}
+		}
+		if e.EnclosureURL != "" {
+			size, _ := strconv.ParseInt(e.EnclosureLength, 10, 64)
+			item.Attachments = []jsonFeedAttachmentOutput{{
+				URL:               e.EnclosureURL,
+				MimeType:          e.enclosureType(),
+				SizeInBytes:       size,
+				DurationInSeconds: int64(e.Duration.Seconds()),
+			}}
+		}
+		feed.Items = append(feed.Items, item)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(feed)
+}
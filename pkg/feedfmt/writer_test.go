@@ -0,0 +1,128 @@
+package feedfmt
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+var writerInfo = FeedInfo{
+	Title:    "rjio",
+	Link:     "http://example.org/",
+	FeedLink: "http://example.org/atom",
+	Author:   "Jane",
+	Language: "th",
+}
+
+var writerEntries = []Entry{
+	{
+		GUID:            "a-1",
+		Title:           "Ep 1 & co",
+		Link:            "http://example.org/1",
+		Description:     "<p>short</p>",
+		PubDate:         time.Date(2023, 1, 2, 3, 0, 0, 0, time.UTC),
+		EnclosureURL:    "http://example.org/1.mp3?x=1",
+		EnclosureLength: "10",
+		Duration:        90 * time.Second,
+	},
+	{GUID: "http://example.org/2", Title: "Ep 2", Content: "long", Description: "short"},
+}
+
+func TestWriteAtom(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteAtom(&b, writerInfo, writerEntries); err != nil {
+		t.Fatalf("WriteAtom error: %v", err)
+	}
+	out := b.String()
+	for _, want := range []string{
+		`<feed xmlns="http://www.w3.org/2005/Atom" xml:lang="th">`,
+		`<id>http://example.org/atom</id>`,
+		`<updated>2023-01-02T03:00:00Z</updated>`,
+		`<link rel="self" href="http://example.org/atom" type="application/atom+xml"></link>`,
+		`<id>http://example.org/1</id>`,
+		`<title>Ep 1 &amp; co</title>`,
+		`<published>2023-01-02T03:00:00Z</published>`,
+		`<link rel="enclosure" href="http://example.org/1.mp3?x=1" type="audio/mpeg" length="10"></link>`,
+		`<summary type="html">&lt;p&gt;short&lt;/p&gt;</summary>`,
+		`<id>http://example.org/2</id>`,
+		`<content type="html">long</content>`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("WriteAtom output is missing %s\n%s", want, out)
+		}
+	}
+}
+
+func TestWriteJSONFeed(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteJSONFeed(&b, writerInfo, writerEntries); err != nil {
+		t.Fatalf("WriteJSONFeed error: %v", err)
+	}
+
+	// what is written must read back as the same entries
+	entries, warnings, err := ParseJSONFeed(b.Bytes())
+	if err != nil || len(warnings) > 0 {
+		t.Fatalf("ParseJSONFeed of written feed: %v %v", err, warnings)
+	}
+	want := []Entry{
+		{
+			GUID:            "a-1",
+			Title:           "Ep 1 & co",
+			Link:            "http://example.org/1",
+			Description:     "<p>short</p>",
+			Content:         "<p>short</p>",
+			PubDate:         time.Date(2023, 1, 2, 3, 0, 0, 0, time.UTC),
+			RawPubDate:      "2023-01-02T03:00:00Z",
+			EnclosureURL:    "http://example.org/1.mp3?x=1",
+			EnclosureType:   "audio/mpeg",
+			EnclosureLength: "10",
+			Duration:        90 * time.Second,
+		},
+		{GUID: "http://example.org/2", Title: "Ep 2", Content: "long", Description: "short"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("read back %d entries, want %d", len(entries), len(want))
+	}
+	for i := range want {
+		entries[i].Raw = ""
+		if entries[i] != want[i] {
+			t.Errorf("entry #%d = %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+
+	var feed map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &feed); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	if feed["version"] != "https://jsonfeed.org/version/1.1" || feed["title"] != "rjio" || feed["language"] != "th" {
+		t.Errorf("unexpected feed fields: %v", feed)
+	}
+}
+
+func TestEntryRSS(t *testing.T) {
+	entry := writerEntries[0]
+	want := `<item><title>Ep 1 &amp; co</title><link>http://example.org/1</link>` +
+		`<guid isPermaLink="false">a-1</guid><pubDate>Mon, 02 Jan 2023 03:00:00 +0000</pubDate>` +
+		`<description>&lt;p&gt;short&lt;/p&gt;</description><itunes:duration>90</itunes:duration>` +
+		`<enclosure url="http://example.org/1.mp3?x=1" length="10" type="audio/mpeg"/></item>`
+	if got := entry.RSS(); got != want {
+		t.Errorf("RSS() = %s, want %s", got, want)
+	}
+
+	node, err := ParseItem(entry.RSS())
+	if err != nil {
+		t.Fatalf("ParseItem error: %v", err)
+	}
+	got := ReadItem(node)
+	if !got.PubDate.Equal(entry.PubDate) {
+		t.Errorf("ReadItem(RSS()).PubDate = %v, want %v", got.PubDate, entry.PubDate)
+	}
+	got.Raw, got.PubDate = "", entry.PubDate
+	entry.RawPubDate = "Mon, 02 Jan 2023 03:00:00 +0000"
+	entry.EnclosureType = "audio/mpeg"
+	if got != entry {
+		t.Errorf("ReadItem(RSS()) = %+v, want %+v", got, entry)
+	}
+}
@@ -3,25 +3,19 @@ package rjio2
 import (
 	"fmt"
 	"io"
-	"net/url"
 	"strings"
 	"text/template"
-	"time"
 
 	"github.com/rs/zerolog/log"
+
+	"github.com/wiennat/rjio/pkg/feedfmt"
 )
 
 // Item represents an item in a feed
 type Item struct {
-	ID           int64     `json:"id"`
-	FeedID       int64     `json:"feedId"`
-	GUID         string    `json:"guid"`
-	Title        string    `json:"title"`
-	Description  string    `json:"description"`
-	PubDate      time.Time `json:"pubdate"`
-	Raw          string    `json:"raw"`
-	EnclosureUrl string    `json:"enclosureUrl"`
-	Entry        string    `json:"entry"`
+	ID     int64 `json:"id"`
+	FeedID int64 `json:"feedId"`
+	feedfmt.Item
 }
 
 type Feed struct {
@@ -32,13 +26,23 @@ type Feed struct {
 
 type Config struct {
 	TrackingPrefix string
+	Trackers       []feedfmt.Tracker
 	TemplatePath   string
 }
 
-func RenderRss(items []Item, config *Config) (string, error) {
-	// add prefix enclosure
+// rewriteEnclosures applies the tracking prefix and trackers to the
+// enclosures of items.
+func (config *Config) rewriteEnclosures(items []Item) ([]Item, error) {
+	rewriter, err := feedfmt.NewEnclosureRewriter(config.TrackingPrefix, config.Trackers)
+	if err != nil {
+		return nil, err
+	}
+	return ApplyEnclosureRewriter(items, rewriter), nil
+}
 
-	d, err := ApplyEnclosurePrefix(items, config.TrackingPrefix)
+func RenderRss(items []Item, config *Config) (string, error) {
+	// rewrite enclosures for tracking
+	d, err := config.rewriteEnclosures(items)
 	if err != nil {
 		return "", fmt.Errorf(err.Error())
 	}
@@ -55,38 +59,58 @@ func RenderRss(items []Item, config *Config) (string, error) {
 	return w.String(), nil
 }
 
-// apply prefix to enclosure url
-func ApplyEnclosurePrefix(items []Item, prefix string) ([]Item, error) {
-	// find enclosure url in Entry and replace with prefix one
-	if prefix == "" {
-		return items, nil
+// RenderAtom renders items as an Atom feed described by info.
+func RenderAtom(items []Item, info feedfmt.FeedInfo, config *Config) (string, error) {
+	d, err := config.rewriteEnclosures(items)
+	if err != nil {
+		return "", err
 	}
 
-	for i, item := range items {
-		if strings.Contains(item.EnclosureUrl, "https://anchor.fm/") {
-			// handle anchor.fm url
-			enclosureURLAttr := fmt.Sprintf("url=\"%s\"", item.EnclosureUrl)
-			colonPosition := strings.Index(item.EnclosureUrl, "://")
-			protocol := item.EnclosureUrl[0:colonPosition]
-			escapedURL := item.EnclosureUrl[(colonPosition + 3):]
-			unescaped, err := url.PathUnescape(escapedURL)
-			if err != nil {
-				return nil, err
-			}
-			newEnclosureURLAttr := fmt.Sprintf("url=\"%s://%s%s\"", protocol, prefix, unescaped)
-			items[i].Entry = strings.Replace(item.Entry, enclosureURLAttr, newEnclosureURLAttr, 1)
-		} else {
-
-			enclosureURLAttr := fmt.Sprintf("url=\"%s\"", item.EnclosureUrl)
-			colonPosition := strings.Index(item.EnclosureUrl, "://")
-			protocol := item.EnclosureUrl[0:colonPosition]
-			url := item.EnclosureUrl[(colonPosition + 3):]
-			newEnclosureURLAttr := fmt.Sprintf("url=\"%s://%s%s\"", protocol, prefix, url)
-			items[i].Entry = strings.Replace(item.Entry, enclosureURLAttr, newEnclosureURLAttr, 1)
-		}
+	var w strings.Builder
+	err = feedfmt.WriteAtom(&w, info, feedEntries(d))
+	if err != nil {
+		return "", err
 	}
+	return w.String(), nil
+}
 
-	return items, nil
+// RenderJSONFeed renders items as a JSON Feed described by info.
+func RenderJSONFeed(items []Item, info feedfmt.FeedInfo, config *Config) (string, error) {
+	d, err := config.rewriteEnclosures(items)
+	if err != nil {
+		return "", err
+	}
+
+	var w strings.Builder
+	err = feedfmt.WriteJSONFeed(&w, info, feedEntries(d))
+	if err != nil {
+		return "", err
+	}
+	return w.String(), nil
+}
+
+func feedEntries(items []Item) []feedfmt.Entry {
+	entries := make([]feedfmt.Entry, 0, len(items))
+	for _, item := range items {
+		entries = append(entries, item.FeedEntry())
+	}
+	return entries
+}
+
+// ApplyEnclosureRewriter rewrites the enclosures of items, leaving them as
+// they are when rewriter is nil. Items that cannot be rewritten are logged
+// and served with their original enclosures.
+func ApplyEnclosureRewriter(items []Item, rewriter feedfmt.EnclosureRewriter) []Item {
+	stored := make([]*feedfmt.Item, len(items))
+	for i := range items {
+		stored[i] = &items[i].Item
+	}
+	for _, err := range feedfmt.ApplyEnclosureRewriter(stored, rewriter) {
+		if err != nil {
+			log.Error().Err(err).Msg("serving item with its original enclosure")
+		}
+	}
+	return items
 }
 
 func renderText(w io.Writer, tmplFile string, param map[string]interface{}) error {
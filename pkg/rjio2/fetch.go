@@ -12,6 +12,7 @@ import (
 	"github.com/rs/zerolog/log"
 
 	"github.com/antchfx/xmlquery"
+	"github.com/wiennat/rjio/pkg/feedfmt"
 
 	"gopkg.in/yaml.v2"
 )
@@ -28,19 +29,36 @@ type FetchOption struct {
 	TemplatePath   string
 	OutputPath     string
 	TrackingPrefix string
+	// Format is the output format: rss (the default), atom or json
+	Format string
 }
 
 type FeedSourceConfig struct {
 	Sources []FeedSourceConfigItem `yaml:"sources"`
+	// Trackers rewrite enclosure URLs after the tracking prefix
+	Trackers []feedfmt.Tracker `yaml:"trackers"`
+	// Channel describes the feed when it is written as Atom or JSON Feed,
+	// RSS takes it from the template
+	Channel feedfmt.FeedInfo `yaml:"channel"`
+	// Rules rewrite the items of every source, itunes:season is removed
+	// when no rules are set
+	Rules []feedfmt.Rule `yaml:"rules"`
 }
 
 type FeedSourceConfigItem struct {
-	Href string `yaml:"href" json:"url"`
-	Slug string `yaml:"slug" json:"slug"`
+	Href  string         `yaml:"href" json:"url"`
+	Slug  string         `yaml:"slug" json:"slug"`
+	Name  string         `yaml:"name" json:"name"`
+	Rules []feedfmt.Rule `yaml:"rules" json:"rules"`
 }
 
 func Execute(option *FetchOption) { // config string, templatePath string, outPath string) {
 	storage := NewFileStorage(".")
+	switch option.Format {
+	case "", "rss", "atom", "json":
+	default:
+		log.Fatal().Msgf("unknown format %s", option.Format)
+	}
 	// read
 	fileContent, err := ioutil.ReadFile(option.SourcePath)
 	if err != nil {
@@ -64,11 +82,26 @@ func Execute(option *FetchOption) { // config string, templatePath string, outPa
 		}
 		c.Sources = arr
 	}
+
+	if strings.HasSuffix(option.SourcePath, ".opml") {
+		c.Sources, err = opmlSources(fileContent)
+		if err != nil {
+			log.Error().Msgf("Unmarshal: %v", err)
+		}
+	}
 		
 
+	if c.Rules == nil {
+		c.Rules = feedfmt.DefaultRules
+	}
+
 	allitems := make([]Item, 0)
 	for _, v := range c.Sources {
-		items, err := doFetch(v.Href)
+		rewriter, err := feedfmt.NewRewriter(append(c.Rules[:len(c.Rules):len(c.Rules)], v.Rules...))
+		if err != nil {
+			log.Fatal().Str("source", v.Href).Err(err).Msg("invalid rules")
+		}
+		items, err := doFetch(v, rewriter)
 		if err != nil {
 			log.Error().AnErr("error", err)
 		} else {
@@ -83,18 +116,29 @@ func Execute(option *FetchOption) { // config string, templatePath string, outPa
 	log.Debug().Msg("------")
 
 	// render
-	rss, err := RenderRss(allitems, &Config{
+	config := &Config{
 		TrackingPrefix: option.TrackingPrefix,
+		Trackers:       c.Trackers,
 		TemplatePath:   option.TemplatePath,
-	})
+	}
+	var output string
+	switch option.Format {
+	case "", "rss":
+		output, err = RenderRss(allitems, config)
+	case "atom":
+		output, err = RenderAtom(allitems, c.Channel, config)
+	case "json":
+		output, err = RenderJSONFeed(allitems, c.Channel, config)
+	}
 
 	if err != nil {
 		log.Fatal().AnErr("error", err)
 	}
-	storage.StoreRSS(option.OutputPath, rss)
+	storage.StoreRSS(option.OutputPath, output)
 }
 
-func doFetch(sourceURL string) (*[]Item, error) {
+func doFetch(source FeedSourceConfigItem, rewriter *feedfmt.Rewriter) (*[]Item, error) {
+	sourceURL := source.Href
 	log.Info().Str("source", sourceURL).Msg("Updating feed")
 	response, err := netClient.Get(sourceURL)
 	if err != nil {
@@ -107,6 +151,27 @@ func doFetch(sourceURL string) (*[]Item, error) {
 		return nil, fmt.Errorf("Error during reading body for %s, err=%v", sourceURL, err)
 	}
 
+	if feedfmt.IsJSONFeed(response.Header.Get("Content-Type"), body) {
+		log.Debug().Str("source", sourceURL).Msg("Parsing json feed")
+		entries, warnings, err := feedfmt.ParseJSONFeed(body)
+		if err != nil {
+			return nil, fmt.Errorf("Error during parsing feed for %s, err=%v", sourceURL, err)
+		}
+		for _, warning := range warnings {
+			log.Warn().Str("source", sourceURL).Msg(warning)
+		}
+		items := make([]Item, 0, len(entries))
+		for i := range entries {
+			item, err := entryItem(&entries[i], source, rewriter)
+			if err != nil {
+				log.Error().Str("guid", entries[i].GUID).Err(err).Msg("cannot rewrite entry")
+				continue
+			}
+			items = append(items, *item)
+		}
+		return &items, nil
+	}
+
 	log.Debug().Str("source", sourceURL).Msg("Parsing rss")
 	doc, err := xmlquery.Parse(strings.NewReader(string(body)))
 	if err != nil {
@@ -114,16 +179,20 @@ func doFetch(sourceURL string) (*[]Item, error) {
 	}
 	log.Debug().Str("source", sourceURL).Msg("Acquiring item list")
 
-	list, err := xmlquery.QueryAll(doc, "//item")
+	itemPath, parse := "//item", parseItem
+	if feedfmt.IsAtom(doc) {
+		itemPath, parse = "//entry", parseAtomEntry
+	}
+	list, err := xmlquery.QueryAll(doc, itemPath)
 	if err != nil {
 		return nil, fmt.Errorf("Error during querying feed items for %s, err=%v", sourceURL, err)
 	}
 
 	items := make([]Item, 0)
 	for _, it := range list {
-		item, err := parseItem(it)
+		item, err := parse(it, source, rewriter)
 		if err != nil {
-			log.Error().Msgf("error, it=%s, err=%v\n", it, err)
+			log.Error().Msgf("error, it=%s, err=%v\n", it.OutputXML(true), err)
 			continue
 		}
 		log.Debug().Str("title", item.Title).Msg("process item done")
@@ -132,7 +201,7 @@ func doFetch(sourceURL string) (*[]Item, error) {
 	return &items, nil
 }
 
-func parseItem(it *xmlquery.Node) (*Item, error) {
+func parseItem(it *xmlquery.Node, source FeedSourceConfigItem, rewriter *feedfmt.Rewriter) (*Item, error) {
 	guidNode := it.SelectElement("guid")
 	if guidNode == nil {
 		return nil, fmt.Errorf("cannot parse guid")
@@ -145,59 +214,76 @@ func parseItem(it *xmlquery.Node) (*Item, error) {
 		return nil, fmt.Errorf("cannot find pubDate")
 	}
 
+	// without a database there is no first seen time to fall back to
 	pubDate := pubdateNode.InnerText()
-	pubDateTime, err := time.Parse(time.RFC1123, pubDate)
+	pubDateTime, err := feedfmt.ParseDate(pubDate)
 	if err != nil {
-		pubDateTime, err = time.Parse(time.RFC1123Z, pubDate)
-		if err != nil {
-			// assign default pubdate
-			pubDateTime = time.Date(2001, time.January, 13, 18, 12, 23, 0, defaultLocation)
-		}
+		log.Warn().Str("guid", guid).Err(err).Msg("using default pubdate")
+		pubDateTime = defaultDate
 	}
 
-	var title string
-	if n := it.SelectElement("title"); n != nil {
-		title = n.InnerText()
+	raw := it.OutputXML(true)
+
+	if err == nil {
+		// write the date back in the format podcast apps expect
+		feedfmt.SetText(pubdateNode, pubDateTime.Format(time.RFC1123Z))
 	}
-	var description string
-	if n := it.SelectElement("description"); n != nil {
-		description = n.InnerText()
+
+	err = rewriter.Apply(it, source)
+	if err != nil {
+		return nil, err
 	}
 
-	var enclosureUrl string
-	if n := it.SelectElement("enclosure"); n != nil {
-		for _, attr := range n.Attr {
-			if attr.Name.Local == "url" {
-				enclosureUrl = attr.Value
-				log.Debug().Str("enclosureUrl", enclosureUrl).Msg("extract enclosure url")
-			}
-		}
+	item := Item{
+		FeedID: 0,
+		Item: feedfmt.Item{
+			GUID:    guid,
+			PubDate: pubDateTime,
+			Raw:     raw,
+			Entry:   feedfmt.OutputXML(it),
+		},
 	}
-	raw := it.OutputXML(true)
+	// read the fields after rewriting so they match the rendered entry
+	item.SetEntryFields(feedfmt.ReadItem(it))
+	return &item, nil
+}
 
-	// remove blacklist node
-	if n := it.SelectElement("itunes:season"); n != nil {
-		prev := n.PrevSibling
-		next := n.NextSibling
-		if prev != nil {
-			prev.NextSibling = next
-		}
+func parseAtomEntry(it *xmlquery.Node, source FeedSourceConfigItem, rewriter *feedfmt.Rewriter) (*Item, error) {
+	entry, err := feedfmt.ParseAtomEntry(it)
+	if err != nil {
+		return nil, err
+	}
+	return entryItem(entry, source, rewriter)
+}
 
-		if next != nil {
-			next.PrevSibling = prev
-		}
+// entryItem maps an entry read from an Atom or JSON feed to an item rendered
+// as an RSS item.
+func entryItem(entry *feedfmt.Entry, source FeedSourceConfigItem, rewriter *feedfmt.Rewriter) (*Item, error) {
+	pubDateTime := entry.PubDate
+	if pubDateTime.IsZero() {
+		log.Warn().Str("guid", entry.GUID).Str("date", entry.RawPubDate).Msg("using default pubdate")
+		pubDateTime = defaultDate
+	}
+
+	rss, err := rewriter.ApplyString(entry.RSS(), source)
+	if err != nil {
+		return nil, err
+	}
+
+	node, err := feedfmt.ParseItem(rss)
+	if err != nil {
+		return nil, err
 	}
 
-	entry := it.OutputXML(true)
 	item := Item{
-		GUID:         guid,
-		FeedID:       0,
-		PubDate:      pubDateTime,
-		Title:        title,
-		Description:  description,
-		Raw:          raw,
-		Entry:        entry,
-		EnclosureUrl: enclosureUrl,
+		FeedID: 0,
+		Item: feedfmt.Item{
+			GUID:    entry.GUID,
+			PubDate: pubDateTime,
+			Raw:     entry.Raw,
+			Entry:   rss,
+		},
 	}
+	item.SetEntryFields(feedfmt.ReadItem(node))
 	return &item, nil
 }
@@ -1,16 +1,18 @@
 package rjio2
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 
 	"github.com/rs/zerolog/log"
+	"github.com/wiennat/rjio/pkg/feedfmt"
 )
 
 type Storage interface {
-	GetTemplate(filename string)
-	GetOPML(filename string)
-	StoreRSS(filename string)
+	GetTemplate(filename string) string
+	GetOPML(filename string) []FeedSourceConfigItem
+	StoreRSS(filename string, str string)
 }
 
 type FileStorage struct {
@@ -34,6 +36,50 @@ func (storage FileStorage) GetTemplate(filename string) string {
 	return string(bytes)
 }
 
+// GetOPML reads the feed subscriptions of an OPML file as sources.
+func (storage FileStorage) GetOPML(filename string) []FeedSourceConfigItem {
+	target := storage.getTargetFilename(filename)
+	bytes, err := ioutil.ReadFile(target)
+	if err != nil {
+		log.Fatal().Msgf("Cannot read source file, error=%v", err)
+		panic(err)
+	}
+
+	sources, err := opmlSources(bytes)
+	if err != nil {
+		log.Fatal().Msgf("Cannot parse opml file, error=%v", err)
+		panic(err)
+	}
+	return sources
+}
+
+// opmlSources converts the outlines of an OPML document to sources, deriving
+// their slugs from the outline names.
+func opmlSources(content []byte) ([]FeedSourceConfigItem, error) {
+	outlines, err := feedfmt.ReadOPML(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+
+	var sources []FeedSourceConfigItem
+	slugs := make(map[string]bool)
+	for _, o := range outlines {
+		base := feedfmt.Slugify(o.Name(), o.XMLURL)
+		slug := base
+		for i := 2; slugs[slug]; i++ {
+			slug = fmt.Sprintf("%s-%d", base, i)
+		}
+		slugs[slug] = true
+
+		name := o.Name()
+		if name == "" {
+			name = slug
+		}
+		sources = append(sources, FeedSourceConfigItem{Href: o.XMLURL, Slug: slug, Name: name})
+	}
+	return sources, nil
+}
+
 func (storage FileStorage) StoreRSS(filename string, str string) {
 	target := storage.getTargetFilename(filename)
 	err := ioutil.WriteFile(target, []byte(str), 0644)